@@ -0,0 +1,123 @@
+package security
+
+import (
+	"errors"
+	"net/http"
+)
+
+// AuthErrorKind classifies why a request could not be authenticated.
+type AuthErrorKind int
+
+// The kinds of a AuthError.
+const (
+	// AuthErrorInvalidCredentials means that the credentials are wrong, e.g. the
+	// signature or the hmac does not match.
+	AuthErrorInvalidCredentials AuthErrorKind = iota
+	// AuthErrorNoCredentials means that the request has no credentials.
+	AuthErrorNoCredentials
+	// AuthErrorUnknownScheme means that the credentials belong to another
+	// authenticator.
+	AuthErrorUnknownScheme
+	// AuthErrorMalformed means that the credentials cannot be parsed.
+	AuthErrorMalformed
+	// AuthErrorExpired means that the token is expired or the timestamp of the
+	// request is outside of the accepted clock skew.
+	AuthErrorExpired
+	// AuthErrorReplayed means that the request was already accepted before.
+	AuthErrorReplayed
+	// AuthErrorUnknownIssuer means that the issuer of the token is not known.
+	AuthErrorUnknownIssuer
+	// AuthErrorUnavailable means that the credentials could not be checked,
+	// e.g. because the keys of the issuer could not be fetched.
+	AuthErrorUnavailable
+)
+
+func (k AuthErrorKind) String() string {
+	switch k {
+	case AuthErrorInvalidCredentials:
+		return "invalid credentials"
+	case AuthErrorNoCredentials:
+		return "no credentials"
+	case AuthErrorUnknownScheme:
+		return "unknown scheme"
+	case AuthErrorMalformed:
+		return "malformed credentials"
+	case AuthErrorExpired:
+		return "expired"
+	case AuthErrorReplayed:
+		return "replayed"
+	case AuthErrorUnknownIssuer:
+		return "unknown issuer"
+	case AuthErrorUnavailable:
+		return "unavailable"
+	default:
+		return "unknown"
+	}
+}
+
+// AuthError is returned by the UserGetters of this package if a request cannot
+// be authenticated. Use errors.As to get the kind and the authenticator of an
+// error, the message is the one of the underlying error.
+type AuthError struct {
+	Kind AuthErrorKind
+	// Authenticator is the UserGetter which returned the error, e.g. "dex" or
+	// "hmac:<type>".
+	Authenticator string
+	Err           error
+}
+
+func (e *AuthError) Error() string {
+	if e.Err == nil {
+		return e.Kind.String()
+	}
+	return e.Err.Error()
+}
+
+func (e *AuthError) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether the target is a AuthError of the same kind. If the target
+// has an underlying error, it must match this one too.
+func (e *AuthError) Is(target error) bool {
+	t, ok := target.(*AuthError)
+	if !ok || t.Kind != e.Kind {
+		return false
+	}
+	return t.Err == nil || errors.Is(e.Err, t.Err)
+}
+
+// Status returns the http status which a server should respond with.
+func (e *AuthError) Status() int {
+	switch e.Kind {
+	case AuthErrorMalformed:
+		return http.StatusBadRequest
+	case AuthErrorUnavailable:
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusUnauthorized
+	}
+}
+
+// newAuthError returns the error as a AuthError of the given authenticator. If
+// the error already contains a AuthError, its kind wins and its authenticator
+// if it is set.
+func newAuthError(authenticator string, kind AuthErrorKind, err error) error {
+	if err == nil {
+		return nil
+	}
+	var ae *AuthError
+	if errors.As(err, &ae) {
+		if ae.Authenticator != "" && err == error(ae) {
+			return err
+		}
+		kind = ae.Kind
+		if ae.Authenticator != "" {
+			authenticator = ae.Authenticator
+		}
+		if err == error(ae) {
+			err = ae.Err
+		}
+	}
+	return &AuthError{Kind: kind, Authenticator: authenticator, Err: err}
+}
@@ -0,0 +1,129 @@
+package security
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestAuthError(t *testing.T) {
+	inner := errors.New("token is expired")
+	err := fmt.Errorf("dex: %w", &AuthError{Kind: AuthErrorExpired, Authenticator: "dex", Err: inner})
+
+	var ae *AuthError
+	require.ErrorAs(t, err, &ae)
+	require.Equal(t, AuthErrorExpired, ae.Kind)
+	require.Equal(t, "dex", ae.Authenticator)
+	require.Equal(t, http.StatusUnauthorized, ae.Status())
+	require.Equal(t, "dex: token is expired", err.Error())
+
+	require.ErrorIs(t, err, inner)
+	require.ErrorIs(t, err, &AuthError{Kind: AuthErrorExpired})
+	require.NotErrorIs(t, err, &AuthError{Kind: AuthErrorMalformed})
+	require.NotErrorIs(t, err, &AuthError{Kind: AuthErrorExpired, Err: errors.New("token is expired")})
+
+	require.Equal(t, "unavailable", (&AuthError{Kind: AuthErrorUnavailable}).Error())
+	require.Equal(t, http.StatusServiceUnavailable, (&AuthError{Kind: AuthErrorUnavailable}).Status())
+	require.Equal(t, http.StatusBadRequest, (&AuthError{Kind: AuthErrorMalformed}).Status())
+}
+
+func Test_newAuthError(t *testing.T) {
+	require.NoError(t, newAuthError("dex", AuthErrorInvalidCredentials, nil))
+
+	err := newAuthError("dex", AuthErrorInvalidCredentials, errNoAuthFound)
+	var ae *AuthError
+	require.ErrorAs(t, err, &ae)
+	require.Equal(t, AuthErrorNoCredentials, ae.Kind)
+	require.Equal(t, "dex", ae.Authenticator)
+	require.Equal(t, "no auth found", err.Error())
+	require.ErrorIs(t, err, errNoAuthFound)
+	require.ErrorIs(t, errNoAuthFound, err)
+
+	// the authenticator of an inner error wins
+	outer := newAuthError("issuercache", AuthErrorInvalidCredentials, fmt.Errorf("wrapped: %w", err))
+	require.ErrorAs(t, outer, &ae)
+	require.Equal(t, AuthErrorNoCredentials, ae.Kind)
+	require.Equal(t, "dex", ae.Authenticator)
+	require.Equal(t, "wrapped: no auth found", outer.Error())
+	require.Same(t, err, newAuthError("issuercache", AuthErrorInvalidCredentials, err))
+}
+
+func TestHMACAuth_UserAuthErrors(t *testing.T) {
+	hm := NewHMACAuth("mytype", []byte{1, 2, 3}, WithNonceStore(NewMemoryNonceStore(10)))
+
+	tests := []struct {
+		name string
+		auth func(rq *http.Request)
+		want AuthErrorKind
+	}{
+		{
+			name: "no credentials",
+			auth: func(rq *http.Request) {},
+			want: AuthErrorNoCredentials,
+		},
+		{
+			name: "other scheme",
+			auth: func(rq *http.Request) { rq.Header.Set(AuthzHeaderKey, "Bearer abc") },
+			want: AuthErrorUnknownScheme,
+		},
+		{
+			name: "malformed",
+			auth: func(rq *http.Request) { rq.Header.Set(AuthzHeaderKey, "mytype v=9,mac=abc") },
+			want: AuthErrorMalformed,
+		},
+		{
+			name: "wrong key",
+			auth: func(rq *http.Request) {
+				other := NewHMACAuth("mytype", []byte{4, 5, 6})
+				other.AddAuth(rq, time.Now(), nil)
+			},
+			want: AuthErrorInvalidCredentials,
+		},
+		{
+			name: "expired",
+			auth: func(rq *http.Request) { hm.AddAuth(rq, time.Now().Add(-time.Hour), nil) },
+			want: AuthErrorExpired,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rq := httptest.NewRequest(http.MethodGet, "/", nil)
+			tt.auth(rq)
+			_, err := hm.User(rq)
+			var ae *AuthError
+			require.ErrorAs(t, err, &ae)
+			require.Equal(t, tt.want, ae.Kind, err.Error())
+			require.Equal(t, "hmac:mytype", ae.Authenticator)
+		})
+	}
+
+	t.Run("replayed", func(t *testing.T) {
+		rq := httptest.NewRequest(http.MethodGet, "/", nil)
+		hm.AddAuth(rq, time.Now(), nil)
+		_, err := hm.User(rq)
+		require.NoError(t, err)
+		_, err = hm.User(rq)
+		require.ErrorIs(t, err, &AuthError{Kind: AuthErrorReplayed})
+		require.ErrorIs(t, err, ErrReplayedRequest)
+	})
+}
+
+func TestUserGetterProxy_AuthErrors(t *testing.T) {
+	p := NewUserGetterProxy(DummyUG{u: dummyUser1})
+
+	_, err := p.User(httptest.NewRequest(http.MethodGet, "/", nil))
+	require.ErrorIs(t, err, &AuthError{Kind: AuthErrorNoCredentials})
+
+	rq := httptest.NewRequest(http.MethodGet, "/", nil)
+	rq.Header.Set(AuthzHeaderKey, "Bearer abc")
+	_, err = p.User(rq)
+	var ae *AuthError
+	require.ErrorAs(t, err, &ae)
+	require.Equal(t, AuthErrorMalformed, ae.Kind)
+	require.Equal(t, "usergetterproxy", ae.Authenticator)
+}
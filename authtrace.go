@@ -0,0 +1,91 @@
+package security
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// AuthAttempt is the outcome of one authenticator of a UserCreds.
+type AuthAttempt struct {
+	Authenticator string
+	// Err is nil if the authenticator returned the user.
+	Err error
+}
+
+// Skipped returns true if the authenticator did not find its credentials in the
+// request, so the next one was tried.
+func (a AuthAttempt) Skipped() bool {
+	return a.Err != nil && isSkippable(a.Err)
+}
+
+func (a AuthAttempt) String() string {
+	switch {
+	case a.Err == nil:
+		return a.Authenticator + ": authenticated"
+	case a.Skipped():
+		return fmt.Sprintf("%s: skipped: %v", a.Authenticator, a.Err)
+	default:
+		return fmt.Sprintf("%s: failed: %v", a.Authenticator, a.Err)
+	}
+}
+
+// AuthTrace collects the outcomes of the authenticators of a UserCreds which
+// tried to authenticate a request. It is safe for concurrent use.
+type AuthTrace struct {
+	lock     sync.Mutex
+	attempts []AuthAttempt
+}
+
+type authTraceKey struct{}
+
+// ContextWithAuthTrace returns a context with a new AuthTrace. A UserCreds with
+// WithAuthTrace records its attempts in the trace of the context of the request.
+func ContextWithAuthTrace(ctx context.Context) (context.Context, *AuthTrace) {
+	t := &AuthTrace{}
+	return context.WithValue(ctx, authTraceKey{}, t), t
+}
+
+// AuthTraceFromContext returns the AuthTrace of the context or nil.
+func AuthTraceFromContext(ctx context.Context) *AuthTrace {
+	t, _ := ctx.Value(authTraceKey{}).(*AuthTrace)
+	return t
+}
+
+func (t *AuthTrace) add(a AuthAttempt) {
+	if t == nil {
+		return
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.attempts = append(t.attempts, a)
+}
+
+// Attempts returns the recorded attempts in the order they were made.
+func (t *AuthTrace) Attempts() []AuthAttempt {
+	if t == nil {
+		return nil
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return append([]AuthAttempt(nil), t.attempts...)
+}
+
+// Err joins the errors of all attempts, each prefixed with its authenticator.
+// It returns nil if no attempt failed or was skipped.
+func (t *AuthTrace) Err() error {
+	var errs []error
+	for _, a := range t.Attempts() {
+		if a.Err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", a.Authenticator, a.Err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// isSkippable returns true if the error means that the credentials of the
+// request belong to another authenticator.
+func isSkippable(err error) bool {
+	return errors.Is(err, errNoAuthFound) || errors.Is(err, errIllegalAuthFound) || errors.Is(err, errUnknownAuthFound)
+}
@@ -0,0 +1,96 @@
+package security
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestUserCreds_WithAuthTrace(t *testing.T) {
+	agent := NewHMACAuth("agent", []byte{1, 2, 3})
+	view := NewHMACAuth("view", []byte{4, 5, 6})
+	dex := failingUserGetter{err: errNoAuthFound}
+
+	t.Run("guest", func(t *testing.T) {
+		uc := NewCreds(WithHMAC(agent), WithHMAC(view), WithDex(dex), WithAuthTrace())
+		ctx, trace := ContextWithAuthTrace(context.Background())
+		rq := httptest.NewRequestWithContext(ctx, http.MethodGet, "/", nil)
+		rq.Header.Set(AuthzHeaderKey, "other abc")
+
+		u, err := uc.User(rq)
+		require.NoError(t, err)
+		require.True(t, u.IsAnonymous())
+
+		attempts := trace.Attempts()
+		require.Len(t, attempts, 3)
+		require.Equal(t, "hmac:agent", attempts[0].Authenticator)
+		require.True(t, attempts[0].Skipped())
+		require.Equal(t, "hmac:agent: skipped: unknown authtype found", attempts[0].String())
+		require.Equal(t, "hmac:view", attempts[1].Authenticator)
+		require.Equal(t, "dex", attempts[2].Authenticator)
+		require.Equal(t, "dex: skipped: no auth found", attempts[2].String())
+		require.EqualError(t, trace.Err(), "hmac:agent: unknown authtype found\nhmac:view: unknown authtype found\ndex: no auth found")
+	})
+
+	t.Run("failure", func(t *testing.T) {
+		uc := NewCreds(WithHMAC(agent), WithHMAC(view), WithAuthTrace())
+		ctx, trace := ContextWithAuthTrace(context.Background())
+		rq := httptest.NewRequestWithContext(ctx, http.MethodGet, "/", nil)
+		wrong := NewHMACAuth("view", []byte{1, 2, 3})
+		wrong.AddAuth(rq, time.Now(), nil)
+
+		_, err := uc.User(rq)
+		require.EqualError(t, err, "Wrong HMAC found")
+
+		attempts := trace.Attempts()
+		require.Len(t, attempts, 2)
+		require.True(t, attempts[0].Skipped())
+		require.False(t, attempts[1].Skipped())
+		require.Equal(t, "hmac:view: failed: Wrong HMAC found", attempts[1].String())
+	})
+
+	t.Run("success", func(t *testing.T) {
+		uc := NewCreds(WithHMAC(agent), WithHMAC(view), WithAuthTrace())
+		ctx, trace := ContextWithAuthTrace(context.Background())
+		rq := httptest.NewRequestWithContext(ctx, http.MethodGet, "/", nil)
+		view.AddAuth(rq, time.Now(), nil)
+
+		_, err := uc.User(rq)
+		require.NoError(t, err)
+		require.Equal(t, "hmac:view: authenticated", trace.Attempts()[1].String())
+		require.EqualError(t, trace.Err(), "hmac:agent: unknown authtype found")
+	})
+
+	t.Run("joined error without context", func(t *testing.T) {
+		uc := NewCreds(WithHMAC(agent), WithDex(dex), WithAuthTrace(), RejectAnonymous())
+		_, err := uc.User(httptest.NewRequest(http.MethodGet, "/", nil))
+		require.ErrorIs(t, err, &AuthError{Kind: AuthErrorNoCredentials})
+		require.EqualError(t, err, "no auth found, anonymous requests are not allowed\nhmac:agent: no auth found\ndex: no auth found")
+	})
+
+	t.Run("without tracing", func(t *testing.T) {
+		uc := NewCreds(WithHMAC(agent))
+		ctx, trace := ContextWithAuthTrace(context.Background())
+		_, err := uc.User(httptest.NewRequestWithContext(ctx, http.MethodGet, "/", nil))
+		require.NoError(t, err)
+		require.Empty(t, trace.Attempts())
+		require.NoError(t, trace.Err())
+	})
+}
+
+func TestMiddleware_AuthTrace(t *testing.T) {
+	uc := NewCreds(WithHMAC(NewHMACAuth("agent", []byte{1, 2, 3})), WithAuthTrace())
+	var attempts []AuthAttempt
+	next := http.HandlerFunc(func(w http.ResponseWriter, rq *http.Request) {
+		attempts = AuthTraceFromContext(rq.Context()).Attempts()
+	})
+	NewMiddleware(uc).Handler(next).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	require.Len(t, attempts, 1)
+	require.True(t, attempts[0].Skipped())
+
+	require.Nil(t, AuthTraceFromContext(context.Background()))
+}
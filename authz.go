@@ -0,0 +1,156 @@
+package security
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// A Permission allows an action, e.g. "machine:get". The permission "*" of a
+// role allows all actions, "machine:*" all actions which start with "machine:".
+type Permission string
+
+func (p Permission) allows(want Permission) bool {
+	if p == "*" || p == want {
+		return true
+	}
+	prefix, ok := strings.CutSuffix(string(p), "*")
+	return ok && strings.HasPrefix(string(want), prefix)
+}
+
+// A RoleBinding grants a role to all users with the given group. If resources
+// are given, the role is only granted for these resources, "*" stands for all.
+type RoleBinding struct {
+	Group     ResourceAccess
+	Role      string
+	Resources []string
+}
+
+func (b RoleBinding) covers(resource string) bool {
+	return len(b.Resources) == 0 || slices.Contains(b.Resources, "*") || slices.Contains(b.Resources, resource)
+}
+
+// ForbiddenError is returned by an Authorizer if a user does not have a
+// permission.
+type ForbiddenError struct {
+	User       string
+	Permission Permission
+	Resource   string
+}
+
+func (f *ForbiddenError) Error() string {
+	if f.Resource == "" {
+		return fmt.Sprintf("user %q has no role with permission %q", f.User, f.Permission)
+	}
+	return fmt.Sprintf("user %q has no role with permission %q on %q", f.User, f.Permission, f.Resource)
+}
+
+// An Authorizer checks the permissions of a user. The permissions are declared as
+// roles which are granted to the groups of the users.
+type Authorizer struct {
+	roles    map[string][]Permission
+	bindings []RoleBinding
+}
+
+// AuthorizerOption is a option type for Authorizer
+type AuthorizerOption func(*Authorizer)
+
+// WithRole declares a role with the given permissions.
+func WithRole(name string, permissions ...Permission) AuthorizerOption {
+	return func(a *Authorizer) {
+		a.roles[name] = append(a.roles[name], permissions...)
+	}
+}
+
+// WithRoleBindings grants roles to groups.
+func WithRoleBindings(bindings ...RoleBinding) AuthorizerOption {
+	return func(a *Authorizer) {
+		a.bindings = append(a.bindings, bindings...)
+	}
+}
+
+// NewAuthorizer returns a new Authorizer. It returns an error if a role binding
+// refers to a role which is not declared.
+func NewAuthorizer(opts ...AuthorizerOption) (*Authorizer, error) {
+	a := &Authorizer{roles: make(map[string][]Permission)}
+	for _, o := range opts {
+		o(a)
+	}
+	var errs []error
+	for _, b := range a.bindings {
+		if _, ok := a.roles[b.Role]; !ok {
+			errs = append(errs, fmt.Errorf("the group %q is bound to the unknown role %q", b.Group, b.Role))
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Can returns true if the user has a role with the permission on the resource.
+func (a *Authorizer) Can(u *User, p Permission, resource string) bool {
+	return a.Check(u, p, resource) == nil
+}
+
+// Check returns a ForbiddenError if the user has no role with the permission on
+// the resource.
+func (a *Authorizer) Check(u *User, p Permission, resource string) error {
+	if u != nil {
+		for _, b := range a.bindings {
+			if !u.HasGroup(b.Group) || !b.covers(resource) {
+				continue
+			}
+			for _, perm := range a.roles[b.Role] {
+				if perm.allows(p) {
+					return nil
+				}
+			}
+		}
+	}
+	name := ""
+	if u != nil {
+		name = u.Name
+	}
+	return &ForbiddenError{User: name, Permission: p, Resource: resource}
+}
+
+// A ResourceFunc returns the resource a request accesses.
+type ResourceFunc func(rq *http.Request) string
+
+// StaticResource returns a ResourceFunc which always returns the given resource.
+func StaticResource(resource string) ResourceFunc {
+	return func(*http.Request) string {
+		return resource
+	}
+}
+
+// PathValueResource returns a ResourceFunc which returns the named wildcard of
+// the pattern the request was routed with by a http.ServeMux.
+func PathValueResource(name string) ResourceFunc {
+	return func(rq *http.Request) string {
+		return rq.PathValue(name)
+	}
+}
+
+// Require returns a middleware which rejects requests with the status 403 if
+// the user in the context of the request does not have the permission on the
+// resource. Put the user into the context before, e.g. with a Middleware. If
+// resource is nil, the permission must be granted for all resources.
+func (a *Authorizer) Require(p Permission, resource ResourceFunc) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, rq *http.Request) {
+			var r string
+			if resource != nil {
+				r = resource(rq)
+			}
+			if err := a.Check(GetUser(rq), p, r); err != nil {
+				http.Error(w, err.Error(), http.StatusForbidden)
+				return
+			}
+			next.ServeHTTP(w, rq)
+		})
+	}
+}
@@ -0,0 +1,122 @@
+package security
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func testAuthorizer(t *testing.T) *Authorizer {
+	a, err := NewAuthorizer(
+		WithRole("viewer", "machine:get", "machine:list"),
+		WithRole("editor", "machine:*"),
+		WithRole("admin", "*"),
+		WithRoleBindings(
+			RoleBinding{Group: "metal-view", Role: "viewer"},
+			RoleBinding{Group: "project-a-edit", Role: "editor", Resources: []string{"project-a"}},
+			RoleBinding{Group: "metal-admin", Role: "admin", Resources: []string{"*"}},
+		),
+	)
+	require.NoError(t, err)
+	return a
+}
+
+func TestAuthorizer_Can(t *testing.T) {
+	a := testAuthorizer(t)
+	viewer := &User{Name: "viewer", Groups: []ResourceAccess{"metal-view"}}
+	editor := &User{Name: "editor", Groups: []ResourceAccess{"metal-view", "project-a-edit"}}
+	admin := &User{Name: "admin", Groups: []ResourceAccess{"metal-admin"}}
+
+	tests := []struct {
+		name       string
+		user       *User
+		permission Permission
+		resource   string
+		want       bool
+	}{
+		{name: "viewer can get", user: viewer, permission: "machine:get", resource: "project-b", want: true},
+		{name: "viewer cannot delete", user: viewer, permission: "machine:delete", resource: "project-a"},
+		{name: "editor can delete in its project", user: editor, permission: "machine:delete", resource: "project-a", want: true},
+		{name: "editor cannot delete in other projects", user: editor, permission: "machine:delete", resource: "project-b"},
+		{name: "editor cannot delete everywhere", user: editor, permission: "machine:delete"},
+		{name: "editor cannot create networks", user: editor, permission: "network:create", resource: "project-a"},
+		{name: "admin can do everything", user: admin, permission: "network:delete", resource: "project-c", want: true},
+		{name: "guest", user: &guest, permission: "machine:get"},
+		{name: "no user", permission: "machine:get"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.want, a.Can(tt.user, tt.permission, tt.resource))
+		})
+	}
+
+	err := a.Check(viewer, "machine:delete", "project-a")
+	var forbidden *ForbiddenError
+	require.ErrorAs(t, err, &forbidden)
+	require.EqualError(t, err, `user "viewer" has no role with permission "machine:delete" on "project-a"`)
+}
+
+func TestNewAuthorizer_UnknownRole(t *testing.T) {
+	_, err := NewAuthorizer(
+		WithRole("viewer", "machine:get"),
+		WithRoleBindings(RoleBinding{Group: "metal-edit", Role: "editor"}),
+	)
+	require.EqualError(t, err, `the group "metal-edit" is bound to the unknown role "editor"`)
+}
+
+func TestAuthorizer_Require(t *testing.T) {
+	a := testAuthorizer(t)
+	editor := &User{Name: "editor", Groups: []ResourceAccess{"project-a-edit"}}
+
+	mux := http.NewServeMux()
+	mux.Handle("DELETE /v1/project/{project}/machine/{id}", a.Require("machine:delete", PathValueResource("project"))(
+		http.HandlerFunc(func(w http.ResponseWriter, rq *http.Request) {
+			w.WriteHeader(http.StatusNoContent)
+		})))
+	mux.Handle("GET /v1/machine", a.Require("machine:list", nil)(http.NotFoundHandler()))
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		wantStatus int
+		wantBody   string
+	}{
+		{
+			name:       "allowed",
+			method:     http.MethodDelete,
+			path:       "/v1/project/project-a/machine/1",
+			wantStatus: http.StatusNoContent,
+		},
+		{
+			name:       "other project",
+			method:     http.MethodDelete,
+			path:       "/v1/project/project-b/machine/1",
+			wantStatus: http.StatusForbidden,
+			wantBody:   "user \"editor\" has no role with permission \"machine:delete\" on \"project-b\"\n",
+		},
+		{
+			name:       "all resources",
+			method:     http.MethodGet,
+			path:       "/v1/machine",
+			wantStatus: http.StatusForbidden,
+			wantBody:   "user \"editor\" has no role with permission \"machine:list\"\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rq := httptest.NewRequest(tt.method, tt.path, nil)
+			rq = rq.WithContext(PutUserInContext(rq.Context(), editor))
+			rec := httptest.NewRecorder()
+			mux.ServeHTTP(rec, rq)
+			require.Equal(t, tt.wantStatus, rec.Code)
+			if tt.wantBody != "" {
+				require.Equal(t, tt.wantBody, rec.Body.String())
+			}
+		})
+	}
+
+	require.True(t, a.Can(&User{Groups: []ResourceAccess{"project-a-edit"}}, "machine:delete", StaticResource("project-a")(nil)))
+}
@@ -0,0 +1,114 @@
+package security
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"connectrpc.com/connect"
+)
+
+// connectInterceptor authenticates the rpcs of a connect handler or adds the
+// credentials to the rpcs of a connect client.
+type connectInterceptor struct {
+	ug    UserGetter
+	creds ClientCredentials
+}
+
+// NewConnectServerInterceptor returns a connect interceptor which authenticates
+// the rpcs with the given UserGetter and puts the user into the context of the
+// handler. Rpcs which cannot be authenticated are rejected with the code
+// Unauthenticated.
+// A connect handler does not know the host of the request, so the host is not
+// bound to the hmac of version 2 of the scheme. Wrap the connect handler with a
+// http middleware if this is needed.
+func NewConnectServerInterceptor(ug UserGetter) connect.Interceptor {
+	return &connectInterceptor{ug: ug}
+}
+
+// NewConnectClientInterceptor returns a connect interceptor which adds the given
+// credentials to the headers of the rpcs.
+func NewConnectClientInterceptor(creds ClientCredentials) connect.Interceptor {
+	return &connectInterceptor{creds: creds}
+}
+
+func (c *connectInterceptor) WrapUnary(next connect.UnaryFunc) connect.UnaryFunc {
+	return func(ctx context.Context, req connect.AnyRequest) (connect.AnyResponse, error) {
+		var err error
+		if req.Spec().IsClient {
+			err = c.addCredentials(req.Spec(), req.Header())
+		} else {
+			ctx, err = c.user(ctx, req.Spec(), req.Header())
+		}
+		if err != nil {
+			return nil, err
+		}
+		return next(ctx, req)
+	}
+}
+
+func (c *connectInterceptor) WrapStreamingClient(next connect.StreamingClientFunc) connect.StreamingClientFunc {
+	return func(ctx context.Context, spec connect.Spec) connect.StreamingClientConn {
+		conn := next(ctx, spec)
+		if err := c.addCredentials(spec, conn.RequestHeader()); err != nil {
+			return &failedStreamingClientConn{StreamingClientConn: conn, err: err}
+		}
+		return conn
+	}
+}
+
+func (c *connectInterceptor) WrapStreamingHandler(next connect.StreamingHandlerFunc) connect.StreamingHandlerFunc {
+	return func(ctx context.Context, conn connect.StreamingHandlerConn) error {
+		ctx, err := c.user(ctx, conn.Spec(), conn.RequestHeader())
+		if err != nil {
+			return err
+		}
+		return next(ctx, conn)
+	}
+}
+
+func (c *connectInterceptor) addCredentials(spec connect.Spec, header http.Header) error {
+	if c.creds == nil {
+		return nil
+	}
+	headers, err := c.creds(rpcRequestData(spec.Procedure, "", header))
+	if err != nil {
+		return connect.NewError(connect.CodeUnauthenticated, fmt.Errorf("cannot create credentials: %w", err))
+	}
+	for k, v := range headers {
+		header.Set(k, v)
+	}
+	return nil
+}
+
+func (c *connectInterceptor) user(ctx context.Context, spec connect.Spec, header http.Header) (context.Context, error) {
+	if c.ug == nil {
+		return ctx, nil
+	}
+	ctx, err := rpcUser(ctx, c.ug, spec.Procedure, "", header)
+	if err != nil {
+		code := connect.CodeUnauthenticated
+		var ae *AuthError
+		if errors.As(err, &ae) && ae.Kind == AuthErrorUnavailable {
+			code = connect.CodeUnavailable
+		}
+		return nil, connect.NewError(code, err)
+	}
+	return ctx, nil
+}
+
+// failedStreamingClientConn fails all operations of a stream whose credentials
+// could not be created.
+type failedStreamingClientConn struct {
+	connect.StreamingClientConn
+	err error
+}
+
+func (f *failedStreamingClientConn) Send(any) error {
+	return f.err
+}
+
+func (f *failedStreamingClientConn) Receive(any) error {
+	return f.err
+}
@@ -0,0 +1,92 @@
+package security
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"connectrpc.com/connect"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+func TestConnectInterceptors(t *testing.T) {
+	useRandomSalt(t)
+	u := User{Name: "Bicycle Repair Man"}
+	server := NewHMACAuth("mytype", []byte{1, 2, 3}, WithUser(u), WithCanonicalRequest())
+	interceptor := connect.WithInterceptors(NewConnectServerInterceptor(NewCreds(WithHMAC(server))))
+
+	whoami := func(ctx context.Context) *wrapperspb.StringValue {
+		return wrapperspb.String(GetUserFromContext(ctx).Name)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/test.v1.Test/WhoAmI", connect.NewUnaryHandler("/test.v1.Test/WhoAmI",
+		func(ctx context.Context, _ *connect.Request[wrapperspb.StringValue]) (*connect.Response[wrapperspb.StringValue], error) {
+			return connect.NewResponse(whoami(ctx)), nil
+		}, interceptor))
+	mux.Handle("/test.v1.Test/WatchWhoAmI", connect.NewServerStreamHandler("/test.v1.Test/WatchWhoAmI",
+		func(ctx context.Context, _ *connect.Request[wrapperspb.StringValue], stream *connect.ServerStream[wrapperspb.StringValue]) error {
+			return stream.Send(whoami(ctx))
+		}, interceptor))
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	tests := []struct {
+		name     string
+		creds    ClientCredentials
+		want     string
+		wantCode connect.Code
+	}{
+		{
+			name:  "hmac",
+			creds: HMACCredentials(NewHMACAuth("mytype", []byte{1, 2, 3}, WithCanonicalRequest())),
+			want:  u.Name,
+		},
+		{
+			name:     "wrong key",
+			creds:    HMACCredentials(NewHMACAuth("mytype", []byte{4, 5, 6})),
+			wantCode: connect.CodeUnauthenticated,
+		},
+		{
+			name:  "no credentials",
+			creds: func(RequestData) (map[string]string, error) { return nil, nil },
+			want:  "anonymous",
+		},
+		{
+			name:     "failing credentials",
+			creds:    BearerCredentials(func() (string, error) { return "", errors.New("expired") }),
+			wantCode: connect.CodeUnauthenticated,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opt := connect.WithInterceptors(NewConnectClientInterceptor(tt.creds))
+			unary := connect.NewClient[wrapperspb.StringValue, wrapperspb.StringValue](srv.Client(), srv.URL+"/test.v1.Test/WhoAmI", opt)
+			streaming := connect.NewClient[wrapperspb.StringValue, wrapperspb.StringValue](srv.Client(), srv.URL+"/test.v1.Test/WatchWhoAmI", opt)
+
+			rsp, err := unary.CallUnary(context.Background(), connect.NewRequest(wrapperspb.String("")))
+			if tt.wantCode != 0 {
+				require.Equal(t, tt.wantCode, connect.CodeOf(err))
+			} else {
+				require.NoError(t, err)
+				require.Equal(t, tt.want, rsp.Msg.GetValue())
+			}
+
+			stream, err := streaming.CallServerStream(context.Background(), connect.NewRequest(wrapperspb.String("")))
+			if err != nil {
+				require.Equal(t, tt.wantCode, connect.CodeOf(err))
+				return
+			}
+			defer stream.Close()
+			if tt.wantCode != 0 {
+				require.False(t, stream.Receive())
+				require.Equal(t, tt.wantCode, connect.CodeOf(stream.Err()))
+				return
+			}
+			require.True(t, stream.Receive(), stream.Err())
+			require.Equal(t, tt.want, stream.Msg().GetValue())
+		})
+	}
+}
@@ -2,11 +2,14 @@ package security
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"slices"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/golang-jwt/jwt/v5"
@@ -15,49 +18,148 @@ import (
 
 const (
 	refetchInterval = 10 * time.Minute
+	// the bounds of the refresh interval which is requested by the cache
+	// headers of the keys
+	minRefetchInterval = time.Minute
+	maxRefetchInterval = time.Hour
 )
 
-type updater struct {
-	updated chan jwk.Set
-}
-
 // A Dex ...
 type Dex struct {
 	baseURL         string
-	keys            chan<- keyRQ
-	update          chan updater
+	jwksURL         string
+	discovery       bool
+	client          *http.Client
 	refreshInterval time.Duration
+	minRefresh      time.Duration
+	maxRefresh      time.Duration
+
+	// keys is read without locking on every verification, the refresher
+	// serializes and rate limits the refreshes
+	keys      atomic.Pointer[keySnapshot]
+	refresher *keyRefresher
 
 	algorithmWhitelist []string
 
 	userExtractor UserExtractorFn
+	projectClaims []string
 
 	jwtParserOptions []jwt.ParserOption
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+	// rescheduled is signaled after every refresh, so the next regular refresh
+	// is scheduled with the interval of the new keys
+	rescheduled chan struct{}
 }
 
-type keyRsp struct {
+// ErrDexClosed is returned by a Dex which was closed.
+var ErrDexClosed = errors.New("dex is closed")
+
+// keySnapshot is the result of the last fetch of the keys. If the fetch
+// failed, the keys of the previous fetch are kept.
+type keySnapshot struct {
 	keys jwk.Set
 	err  error
-}
-type keyRQ struct {
-	rsp chan<- keyRsp
+	etag string
+	// next is the interval until the next regular refresh
+	next time.Duration
 }
 
-// NewDex returns a new Dex.
+// NewDex returns a new Dex. The keys are fetched in the background until the
+// Dex is closed.
 func NewDex(baseurl string) (*Dex, error) {
+	return NewDexWithContext(context.Background(), baseurl)
+}
+
+// NewDexWithContext returns a new Dex which fetches the keys in the background
+// until the given context is done or the Dex is closed. The options are applied
+// before the keys are fetched, so they can configure where the keys are
+// fetched from.
+func NewDexWithContext(ctx context.Context, baseurl string, opts ...Option) (*Dex, error) {
+	ctx, cancel := context.WithCancel(ctx)
 	dx := &Dex{
 		baseURL:         baseurl,
+		client:          http.DefaultClient,
 		refreshInterval: refetchInterval,
+		minRefresh:      minRefetchInterval,
+		maxRefresh:      maxRefetchInterval,
 		userExtractor:   defaultUserExtractor,
+		projectClaims:   []string{"project"},
+		refresher:       newKeyRefresher(minKeyRefreshInterval),
 
 		algorithmWhitelist: []string{"RS256", "RS512"},
+
+		ctx:    ctx,
+		cancel: cancel,
+		done:   make(chan struct{}),
+
+		rescheduled: make(chan struct{}, 1),
+	}
+	dx.With(opts...)
+	if err := dx.resolveJWKSURL(); err != nil {
+		cancel()
+		return nil, err
 	}
 	if err := dx.keyfetcher(); err != nil {
+		cancel()
 		return nil, err
 	}
 	return dx, nil
 }
 
+// resolveJWKSURL sets the url of the keys if it was not set explicitly. With
+// discovery it is read from the openid configuration of the issuer, otherwise
+// it is "<baseurl>/keys".
+func (dx *Dex) resolveJWKSURL() error {
+	if dx.jwksURL != "" {
+		return nil
+	}
+	if !dx.discovery {
+		dx.jwksURL = dx.baseURL + "/keys"
+		return nil
+	}
+	wellKnown := strings.TrimSuffix(dx.baseURL, "/") + "/.well-known/openid-configuration"
+	rq, err := http.NewRequestWithContext(dx.ctx, http.MethodGet, wellKnown, nil)
+	if err != nil {
+		return err
+	}
+	rsp, err := dx.client.Do(rq)
+	if err != nil {
+		return fmt.Errorf("cannot discover dex: %w", err)
+	}
+	defer func() {
+		_ = rsp.Body.Close()
+	}()
+	if rsp.StatusCode != http.StatusOK {
+		return fmt.Errorf("cannot discover dex from %s: unexpected status %q", wellKnown, rsp.Status)
+	}
+	var meta struct {
+		Issuer  string `json:"issuer"`
+		JWKSURL string `json:"jwks_uri"`
+	}
+	if err := json.NewDecoder(rsp.Body).Decode(&meta); err != nil {
+		return fmt.Errorf("cannot decode openid configuration from %s: %w", wellKnown, err)
+	}
+	if strings.TrimSuffix(meta.Issuer, "/") != strings.TrimSuffix(dx.baseURL, "/") {
+		return fmt.Errorf("the issuer %q of the openid configuration does not match %q", meta.Issuer, dx.baseURL)
+	}
+	if meta.JWKSURL == "" {
+		return fmt.Errorf("the openid configuration from %s has no jwks_uri", wellKnown)
+	}
+	dx.jwksURL = meta.JWKSURL
+	return nil
+}
+
+// Close stops the background fetching of the keys and aborts running requests.
+// Afterwards User returns an error which wraps ErrDexClosed.
+func (dx *Dex) Close() error {
+	dx.cancel()
+	<-dx.done
+	return nil
+}
+
 // Option configures Dex
 type Option func(dex *Dex) *Dex
 
@@ -81,6 +183,35 @@ type Claims struct {
 
 	// added for parsing of "new" style tokens
 	Roles []string `json:"roles"`
+
+	raw map[string]any
+}
+
+// UnmarshalJSON implements the json.Unmarshaler, all claims are kept so they
+// can be read with Project.
+func (c *Claims) UnmarshalJSON(data []byte) error {
+	type claims Claims
+	if err := json.Unmarshal(data, (*claims)(c)); err != nil {
+		return err
+	}
+	return json.Unmarshal(data, &c.raw)
+}
+
+// Project returns the value of the first of the given claims which is a non
+// empty string.
+func (c *Claims) Project(names ...string) string {
+	return stringClaim(c.raw, names)
+}
+
+// stringClaim returns the value of the first of the given claims which is a non
+// empty string.
+func stringClaim(raw map[string]any, names []string) string {
+	for _, n := range names {
+		if v, ok := raw[n].(string); ok && v != "" {
+			return v
+		}
+	}
+	return ""
 }
 
 // UserExtractorFn extracts the User and Claims
@@ -102,6 +233,61 @@ func AlgorithmsWhitelist(algNames []string) Option {
 	}
 }
 
+// ProjectClaims sets the claims which contain the project of the user, the
+// first one which is set wins. The default is "project". The project is only
+// set if the UserExtractorFn did not set one.
+func ProjectClaims(names ...string) Option {
+	return func(dex *Dex) *Dex {
+		dex.projectClaims = names
+		return dex
+	}
+}
+
+// MinKeyRefreshInterval sets the minimum interval between two fetches of the
+// keys which are caused by tokens with unknown key ids, the default is 10
+// seconds. Concurrent fetches are always coalesced. It must be passed to
+// NewDexWithContext, setting it with With afterwards races with verifications.
+func MinKeyRefreshInterval(d time.Duration) Option {
+	return func(dex *Dex) *Dex {
+		dex.refresher.minInterval = d
+		return dex
+	}
+}
+
+// RefreshIntervalBounds sets the bounds of the interval in which the keys are
+// refreshed. The interval is taken from the Cache-Control or Expires headers
+// of the keys, if there are none, the keys are refreshed every 10 minutes. The
+// defaults are one minute and one hour. It must be passed to
+// NewDexWithContext, setting it with With afterwards races with the refreshes
+// in the background.
+func RefreshIntervalBounds(minInterval, maxInterval time.Duration) Option {
+	return func(dex *Dex) *Dex {
+		dex.minRefresh = minInterval
+		dex.maxRefresh = maxInterval
+		return dex
+	}
+}
+
+// Discovery lets the Dex read the url of the keys from the openid configuration
+// of the issuer, i.e. "<baseurl>/.well-known/openid-configuration". The issuer
+// of the configuration must match the baseurl. It only has an effect if it is
+// passed to NewDexWithContext.
+func Discovery() Option {
+	return func(dex *Dex) *Dex {
+		dex.discovery = true
+		return dex
+	}
+}
+
+// JWKSURL sets the url of the keys, the default is "<baseurl>/keys". It wins
+// over Discovery and only has an effect if it is passed to NewDexWithContext.
+func JWKSURL(url string) Option {
+	return func(dex *Dex) *Dex {
+		dex.jwksURL = url
+		return dex
+	}
+}
+
 func JWTParserOptions(opt jwt.ParserOption) Option {
 	return func(dex *Dex) *Dex {
 		dex.jwtParserOptions = append(dex.jwtParserOptions, opt)
@@ -113,84 +299,190 @@ func (dx *Dex) algorithmSupported(alg string) bool {
 	return slices.Contains(dx.algorithmWhitelist, alg)
 }
 
-// the keyfetcher fetches the keys from the remote dex at a regular interval.
-// if the client needs the keys it returns the cached keys.
+// the keyfetcher fetches the keys from the remote dex and refreshes them in the
+// background in the interval which is requested by the cache headers of the
+// keys. The current keys are stored in a snapshot which is swapped atomically,
+// so verifications never wait for a refresh.
 func (dx *Dex) keyfetcher() error {
-	c := make(chan keyRQ)
-	dx.keys = c
-	dx.update = make(chan updater)
-	keys, err := jwk.Fetch(context.Background(), dx.baseURL+"/keys")
-	if err != nil {
-		return fmt.Errorf("cannot fetch dex keys from %s/keys: %w", dx.baseURL, err)
+	snap := dx.updateKeys(&keySnapshot{})
+	if snap.err != nil {
+		return snap.err
 	}
-	t := time.NewTicker(dx.refreshInterval)
+	dx.keys.Store(snap)
+	t := time.NewTimer(snap.next)
 	go func() {
-		defer close(c)
+		defer close(dx.done)
 		defer t.Stop()
 		for {
 			select {
-			case keyRQ := <-c:
-				keyRQ.rsp <- keyRsp{keys, err}
+			case <-dx.ctx.Done():
+				return
 			case <-t.C:
-				keys, err = dx.updateKeys(keys)
-			case u := <-dx.update:
-				keys, err = dx.updateKeys(keys)
-				u.updated <- keys
+				dx.refresher.refresh(dx.refresh)
+			case <-dx.rescheduled:
+				t.Reset(dx.keys.Load().next)
 			}
 		}
 	}()
 	return nil
 }
 
-// fetchKeys asks the current keyfetcher to give the current keyset
+// fetchKeys returns the current keyset.
 func (dx *Dex) fetchKeys() (jwk.Set, error) {
-	outchan := make(chan keyRsp)
-	krq := keyRQ{rsp: outchan}
-	defer close(krq.rsp)
-	dx.keys <- krq
-	rsp := <-outchan
-	return rsp.keys, rsp.err
+	if dx.ctx.Err() != nil {
+		return nil, ErrDexClosed
+	}
+	snap := dx.keys.Load()
+	return snap.keys, snap.err
 }
 
+// forceUpdate refreshes the keys immediately. Other verifications still use the
+// current snapshot while the keys are fetched.
 func (dx *Dex) forceUpdate() {
-	u := updater{
-		updated: make(chan jwk.Set),
+	dx.refresher.refresh(dx.refresh)
+}
+
+// refresh fetches the keys and stores them in a new snapshot, callers must hold
+// the lock of the refresher.
+func (dx *Dex) refresh() error {
+	if dx.ctx.Err() != nil {
+		return ErrDexClosed
 	}
-	defer close(u.updated)
-	dx.update <- u
-	<-u.updated
+	snap := dx.updateKeys(dx.keys.Load())
+	dx.keys.Store(snap)
+	select {
+	case dx.rescheduled <- struct{}{}:
+	default:
+	}
+	return snap.err
 }
 
-func (dx *Dex) updateKeys(old jwk.Set) (jwk.Set, error) {
-	k, e := jwk.Fetch(context.Background(), dx.baseURL+"/keys")
-	if e != nil {
-		return old, fmt.Errorf("cannot fetch dex keys from %s/keys: %w", dx.baseURL, e)
+// updateKeys fetches the keys, the etag of the old snapshot is sent, so the
+// keys are only transferred if they changed. On errors, the old keys are kept
+// and the keys are fetched again after the minimum interval.
+func (dx *Dex) updateKeys(old *keySnapshot) *keySnapshot {
+	keys, etag, maxAge, err := dx.getKeys(old.etag)
+	if err != nil {
+		return &keySnapshot{
+			keys: old.keys,
+			etag: old.etag,
+			err:  fmt.Errorf("cannot fetch dex keys from %s: %w", dx.jwksURL, err),
+			next: dx.minRefresh,
+		}
+	}
+	if keys == nil {
+		keys = old.keys
+	}
+	return &keySnapshot{
+		keys: keys,
+		etag: etag,
+		next: min(max(maxAge, dx.minRefresh), dx.maxRefresh),
 	}
-	return k, e
+}
+
+// getKeys returns the keys, their etag and how long they may be cached. If the
+// keys did not change, the returned keys are nil.
+func (dx *Dex) getKeys(etag string) (jwk.Set, string, time.Duration, error) {
+	rq, err := http.NewRequestWithContext(dx.ctx, http.MethodGet, dx.jwksURL, nil)
+	if err != nil {
+		return nil, "", 0, err
+	}
+	if etag != "" {
+		rq.Header.Set("If-None-Match", etag)
+	}
+	rsp, err := dx.client.Do(rq)
+	if err != nil {
+		return nil, "", 0, err
+	}
+	defer func() {
+		_ = rsp.Body.Close()
+	}()
+	maxAge, ok := cacheMaxAge(rsp.Header, time.Now())
+	if !ok {
+		maxAge = dx.refreshInterval
+	}
+	switch rsp.StatusCode {
+	case http.StatusNotModified:
+		if newEtag := rsp.Header.Get("ETag"); newEtag != "" {
+			etag = newEtag
+		}
+		return nil, etag, maxAge, nil
+	case http.StatusOK:
+	default:
+		return nil, "", 0, fmt.Errorf("unexpected status %q", rsp.Status)
+	}
+	body, err := io.ReadAll(rsp.Body)
+	if err != nil {
+		return nil, "", 0, err
+	}
+	keys, err := jwk.Parse(body)
+	if err != nil {
+		return nil, "", 0, err
+	}
+	return keys, rsp.Header.Get("ETag"), maxAge, nil
 }
 
 // searchKey searches the given key in the set loaded from dex. If
-// there is a key it will be returned otherwise an error is returned
+// there is a key it will be returned otherwise an error is returned. If the
+// keys could not be fetched, the previous keys are still used.
 func (dx *Dex) searchKey(kid string) (any, error) {
+	var (
+		refreshed bool
+		fetchErr  error
+	)
 	for range 2 {
+		gen := dx.refresher.generation.Load()
 		keys, err := dx.fetchKeys()
-		if err != nil {
-			return nil, err
+		if errors.Is(err, ErrDexClosed) {
+			return nil, &AuthError{Kind: AuthErrorUnavailable, Err: err}
+		}
+		fetchErr = err
+		if jwtkey, ok := keys.LookupKeyID(kid); ok {
+			var key any
+			err = jwk.Export(jwtkey, &key)
+			return key, err
 		}
-		jwtkey, ok := keys.LookupKeyID(kid)
+		ok, err := dx.refresher.refreshUnknown(kid, gen, dx.refresh)
 		if !ok {
-			dx.forceUpdate()
-			continue
+			break
 		}
-		var key any
-		err = jwk.Export(jwtkey, &key)
-		return key, err
+		refreshed = err == nil
+	}
+	if fetchErr != nil && !refreshed {
+		return nil, &AuthError{Kind: AuthErrorUnavailable, Err: fetchErr}
+	}
+	if refreshed {
+		dx.refresher.markUnknown(kid)
 	}
 	return nil, fmt.Errorf("key %q not found", kid)
 }
 
-// User implements the UserGetter to get a user from the request.
+// User implements the UserGetter to get a user from the request. All errors
+// are of the type *AuthError.
 func (dx *Dex) User(rq *http.Request) (*User, error) {
+	u, err := dx.user(rq)
+	if err != nil {
+		return nil, newAuthError("dex", jwtErrorKind(err), err)
+	}
+	return u, nil
+}
+
+// jwtErrorKind returns the kind of an error of the jwt parser.
+func jwtErrorKind(err error) AuthErrorKind {
+	switch {
+	case errors.Is(err, jwt.ErrTokenExpired), errors.Is(err, jwt.ErrTokenNotValidYet), errors.Is(err, jwt.ErrTokenUsedBeforeIssued):
+		return AuthErrorExpired
+	case errors.Is(err, jwt.ErrTokenMalformed):
+		return AuthErrorMalformed
+	default:
+		return AuthErrorInvalidCredentials
+	}
+}
+
+func (dx *Dex) user(rq *http.Request) (*User, error) {
+	if dx.ctx.Err() != nil {
+		return nil, &AuthError{Kind: AuthErrorUnavailable, Err: ErrDexClosed}
+	}
 	auth := rq.Header.Get("Authorization")
 	if auth == "" {
 		return nil, errNoAuthFound
@@ -220,7 +512,14 @@ func (dx *Dex) User(rq *http.Request) (*User, error) {
 		return nil, err
 	}
 	if claims, ok := token.Claims.(*Claims); ok && token.Valid {
-		return dx.userExtractor(claims)
+		usr, err := dx.userExtractor(claims)
+		if err != nil {
+			return nil, err
+		}
+		if usr != nil && usr.Project == "" {
+			usr.Project = claims.Project(dx.projectClaims...)
+		}
+		return usr, nil
 	}
 	return nil, errors.New("invalid claims")
 }
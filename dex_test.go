@@ -1,6 +1,7 @@
 package security
 
 import (
+	"context"
 	"crypto/rsa"
 	"encoding/base64"
 	"math/big"
@@ -18,6 +19,7 @@ import (
 
 	"time"
 
+	"github.com/go-jose/go-jose/v4"
 	"github.com/golang-jwt/jwt/v5"
 )
 
@@ -277,6 +279,37 @@ func TestDex_User(t *testing.T) {
 	}
 }
 
+func TestDex_UserAuthErrors(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, rq *http.Request) {
+		_ = json.NewEncoder(w).Encode(secondkeydata)
+	}))
+	defer srv.Close()
+	dx, err := NewDex(srv.URL)
+	require.NoError(t, err)
+	dx.With(JWTParserOptions(jwt.WithTimeFunc(func() time.Time {
+		return time.Date(2019, time.May, 10, 6, 6, 0, 0, time.UTC)
+	})))
+
+	var ae *AuthError
+	_, err = dx.User(httptest.NewRequest(http.MethodGet, srv.URL, nil))
+	require.ErrorAs(t, err, &ae)
+	require.Equal(t, AuthErrorNoCredentials, ae.Kind)
+	require.Equal(t, "dex", ae.Authenticator)
+
+	rq := httptest.NewRequest(http.MethodGet, srv.URL, nil)
+	rq.Header.Add("Authorization", "Bearer "+authtokenAlgRS256)
+	_, err = dx.User(rq)
+	require.ErrorAs(t, err, &ae)
+	require.Equal(t, AuthErrorExpired, ae.Kind)
+	require.Equal(t, "token has invalid claims: token is expired", err.Error())
+
+	rq = httptest.NewRequest(http.MethodGet, srv.URL, nil)
+	rq.Header.Add("Authorization", "Bearer abc")
+	_, err = dx.User(rq)
+	require.ErrorAs(t, err, &ae)
+	require.Equal(t, AuthErrorMalformed, ae.Kind)
+}
+
 func TestDex_UserWithOptions(t *testing.T) {
 	test := []struct {
 		name string
@@ -366,3 +399,256 @@ func TestDex_UserWithOptions(t *testing.T) {
 		})
 	}
 }
+
+func TestDex_UserProject(t *testing.T) {
+	tc := DefaultTokenCfg()
+	tc.ExtraClaims = map[string]any{"project": "p1", "metal_project": "p2"}
+	token, pubKey, _ := MustCreateTokenAndKeys(tc)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, rq *http.Request) {
+		_ = json.NewEncoder(w).Encode(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{pubKey}})
+	}))
+	defer srv.Close()
+
+	dx, err := NewDex(srv.URL)
+	require.NoError(t, err)
+	rq := httptest.NewRequest(http.MethodGet, srv.URL, nil)
+	rq.Header.Add("Authorization", "Bearer "+token)
+
+	u, err := dx.User(rq)
+	require.NoError(t, err)
+	require.Equal(t, "p1", u.Project)
+
+	dx.With(ProjectClaims("metal_project", "project"))
+	u, err = dx.User(rq)
+	require.NoError(t, err)
+	require.Equal(t, "p2", u.Project)
+
+	dx.With(UserExtractor(func(claims *Claims) (*User, error) {
+		return &User{Name: claims.Name, Project: "fixed"}, nil
+	}))
+	u, err = dx.User(rq)
+	require.NoError(t, err)
+	require.Equal(t, "fixed", u.Project)
+}
+
+func TestDex_Close(t *testing.T) {
+	var (
+		requests = make(chan struct{}, 10)
+		block    = make(chan struct{})
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, rq *http.Request) {
+		requests <- struct{}{}
+		if len(requests) > 1 {
+			select {
+			case <-rq.Context().Done():
+			case <-block:
+			}
+			return
+		}
+		_ = json.NewEncoder(w).Encode(secondkeydata)
+	}))
+	defer srv.Close()
+	defer close(block)
+
+	dx, err := NewDexWithContext(context.Background(), srv.URL)
+	require.NoError(t, err)
+
+	// the second fetch hangs until the dex is closed
+	updated := make(chan struct{})
+	go func() {
+		dx.forceUpdate()
+		close(updated)
+	}()
+	<-requests
+	<-requests
+
+	closed := make(chan struct{})
+	go func() {
+		require.NoError(t, dx.Close())
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("close did not abort the running fetch")
+	}
+	<-updated
+
+	_, err = dx.fetchKeys()
+	require.ErrorIs(t, err, ErrDexClosed)
+
+	rq := httptest.NewRequest(http.MethodGet, srv.URL, nil)
+	rq.Header.Add("Authorization", "Bearer "+authtokenAlgRS256)
+	_, err = dx.User(rq)
+	require.ErrorIs(t, err, ErrDexClosed)
+	var ae *AuthError
+	require.ErrorAs(t, err, &ae)
+	require.Equal(t, AuthErrorUnavailable, ae.Kind)
+	require.Equal(t, "dex", ae.Authenticator)
+
+	require.NoError(t, dx.Close())
+}
+
+func TestNewDexWithContext(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, rq *http.Request) {
+		_ = json.NewEncoder(w).Encode(secondkeydata)
+	}))
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	dx, err := NewDexWithContext(ctx, srv.URL)
+	require.NoError(t, err)
+	cancel()
+	select {
+	case <-dx.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the key fetcher was not stopped")
+	}
+	_, err = dx.fetchKeys()
+	require.ErrorIs(t, err, ErrDexClosed)
+
+	_, err = NewDexWithContext(ctx, srv.URL)
+	require.ErrorIs(t, err, context.Canceled)
+}
+
+// BenchmarkDex_User verifies tokens in parallel, the throughput should scale
+// with the number of cores, e.g. go test -bench Dex_User -cpu 1,2,4,8
+func BenchmarkDex_User(b *testing.B) {
+	token, pubKey, _ := MustCreateTokenAndKeys(DefaultTokenCfg())
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, rq *http.Request) {
+		_ = json.NewEncoder(w).Encode(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{pubKey}})
+	}))
+	defer srv.Close()
+
+	dx, err := NewDex(srv.URL)
+	require.NoError(b, err)
+	defer func() { _ = dx.Close() }()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		rq := httptest.NewRequest(http.MethodGet, srv.URL, nil)
+		rq.Header.Add("Authorization", "Bearer "+token)
+		for pb.Next() {
+			if _, err := dx.User(rq); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
+
+func TestDex_fetchKeysDuringRefresh(t *testing.T) {
+	var (
+		requests = make(chan struct{}, 10)
+		block    = make(chan struct{})
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, rq *http.Request) {
+		requests <- struct{}{}
+		if len(requests) > 1 {
+			<-block
+		}
+		_ = json.NewEncoder(w).Encode(secondkeydata)
+	}))
+	defer srv.Close()
+
+	dx, err := NewDex(srv.URL)
+	require.NoError(t, err)
+	defer func() { _ = dx.Close() }()
+
+	updated := make(chan struct{})
+	go func() {
+		dx.forceUpdate()
+		close(updated)
+	}()
+	<-requests
+	<-requests
+
+	// the refresh hangs, but the current keys are still available
+	keys, err := dx.fetchKeys()
+	require.NoError(t, err)
+	require.Equal(t, len(secondkeys), keys.Len())
+
+	close(block)
+	<-updated
+}
+
+func TestDex_Discovery(t *testing.T) {
+	var issuer string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, rq *http.Request) {
+		switch rq.URL.Path {
+		case "/dex/.well-known/openid-configuration":
+			_ = json.NewEncoder(w).Encode(providerJSON{Issuer: issuer, JWKSURL: issuer + "/certs"})
+		case "/dex/certs", "/pinned":
+			_ = json.NewEncoder(w).Encode(secondkeydata)
+		default:
+			http.NotFound(w, rq)
+		}
+	}))
+	defer srv.Close()
+	issuer = srv.URL + "/dex"
+
+	tests := []struct {
+		name     string
+		baseurl  string
+		issuer   string
+		opts     []Option
+		wantJWKS string
+		wantErr  string
+	}{
+		{
+			name:     "discovery",
+			baseurl:  srv.URL + "/dex",
+			issuer:   srv.URL + "/dex",
+			opts:     []Option{Discovery()},
+			wantJWKS: srv.URL + "/dex/certs",
+		},
+		{
+			name:     "trailing slash",
+			baseurl:  srv.URL + "/dex/",
+			issuer:   srv.URL + "/dex",
+			opts:     []Option{Discovery()},
+			wantJWKS: srv.URL + "/dex/certs",
+		},
+		{
+			name:    "issuer mismatch",
+			baseurl: srv.URL + "/dex",
+			issuer:  "https://dex.example.com",
+			opts:    []Option{Discovery()},
+			wantErr: `the issuer "https://dex.example.com" of the openid configuration does not match "` + srv.URL + `/dex"`,
+		},
+		{
+			name:    "no openid configuration",
+			baseurl: srv.URL,
+			opts:    []Option{Discovery()},
+			wantErr: `cannot discover dex from ` + srv.URL + `/.well-known/openid-configuration: unexpected status "404 Not Found"`,
+		},
+		{
+			name:     "pinned jwks url",
+			baseurl:  srv.URL,
+			opts:     []Option{Discovery(), JWKSURL(srv.URL + "/pinned")},
+			wantJWKS: srv.URL + "/pinned",
+		},
+		{
+			name:    "without discovery",
+			baseurl: srv.URL + "/dex",
+			wantErr: `cannot fetch dex keys from ` + srv.URL + `/dex/keys: unexpected status "404 Not Found"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			issuer = tt.issuer
+			dx, err := NewDexWithContext(context.Background(), tt.baseurl, tt.opts...)
+			if tt.wantErr != "" {
+				require.EqualError(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			defer func() { _ = dx.Close() }()
+			require.Equal(t, tt.wantJWKS, dx.jwksURL)
+			keys, err := dx.fetchKeys()
+			require.NoError(t, err)
+			require.Equal(t, len(secondkeys), keys.Len())
+		})
+	}
+}
@@ -0,0 +1,67 @@
+package security
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"strings"
+)
+
+// DigestHeaderKey is the header which transports the digest of the message
+// content as specified in RFC 9530.
+const DigestHeaderKey = "Content-Digest"
+
+var errNoDigestFound = errors.New("no supported digest found")
+
+// digestAlgorithms maps the RFC 9530 algorithm keys we support to their hash.
+var digestAlgorithms = map[string]func() hash.Hash{
+	"sha-256": sha256.New,
+	"sha-512": sha512.New,
+}
+
+// contentDigest returns the value for a Content-Digest header of the given body
+// using sha-256.
+func contentDigest(body []byte) string {
+	sum := sha256.Sum256(body)
+	return "sha-256=:" + base64.StdEncoding.EncodeToString(sum[:]) + ":"
+}
+
+// verifyContentDigest checks the given Content-Digest header value against
+// the body. Unknown algorithms are ignored, but at least one supported
+// algorithm must be present and every supported one must match.
+func verifyContentDigest(header string, body []byte) error {
+	found := false
+	for member := range strings.SplitSeq(header, ",") {
+		alg, value, ok := strings.Cut(strings.TrimSpace(member), "=")
+		if !ok {
+			return fmt.Errorf("illegal digest %q in %q header", member, DigestHeaderKey)
+		}
+		newHash, ok := digestAlgorithms[strings.ToLower(alg)]
+		if !ok {
+			continue
+		}
+		if len(value) < 2 || value[0] != ':' || value[len(value)-1] != ':' {
+			return fmt.Errorf("illegal digest value for %q in %q header", alg, DigestHeaderKey)
+		}
+		want, err := base64.StdEncoding.DecodeString(value[1 : len(value)-1])
+		if err != nil {
+			return fmt.Errorf("illegal digest value for %q in %q header: %w", alg, DigestHeaderKey, err)
+		}
+		h := newHash()
+		// a hash.Hash never returns an error on write
+		//nolint:errcheck
+		h.Write(body)
+		if subtle.ConstantTimeCompare(h.Sum(nil), want) != 1 {
+			return fmt.Errorf("the %q digest in %q header does not match the content", alg, DigestHeaderKey)
+		}
+		found = true
+	}
+	if !found {
+		return errNoDigestFound
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package security
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_contentDigest(t *testing.T) {
+	// test vector from RFC 9530, appendix B.1
+	require.Equal(t, "sha-256=:X48E9qOokqqrvdts8nOJRJN3OWDUoyWxBf7kbu9DBPE=:", contentDigest([]byte("{\"hello\": \"world\"}")))
+}
+
+func Test_verifyContentDigest(t *testing.T) {
+	body := []byte("{\"hello\": \"world\"}")
+	tests := []struct {
+		name    string
+		header  string
+		body    []byte
+		wantErr string
+	}{
+		{
+			name:   "sha-256",
+			header: "sha-256=:X48E9qOokqqrvdts8nOJRJN3OWDUoyWxBf7kbu9DBPE=:",
+			body:   body,
+		},
+		{
+			name:   "sha-512 and unknown algorithm",
+			header: "unixsum=:30637:, sha-512=:WZDPaVn/7XgHaAy8pmojAkGWoRx2UFChF41A2svX+TaPm+AbwAgBWnrIiYllu7BNNyealdVLvRwEmTHWXvJwew==:",
+			body:   body,
+		},
+		{
+			name:    "tampered body",
+			header:  "sha-256=:X48E9qOokqqrvdts8nOJRJN3OWDUoyWxBf7kbu9DBPE=:",
+			body:    []byte("{\"hello\": \"moon\"}"),
+			wantErr: "the \"sha-256\" digest in \"Content-Digest\" header does not match the content",
+		},
+		{
+			name:    "only unknown algorithms",
+			header:  "md5=:HJgawbhYaCBvzdhq+PIpuQ==:",
+			body:    body,
+			wantErr: "no supported digest found",
+		},
+		{
+			name:    "no byte sequence",
+			header:  "sha-256=X48E9qOokqqrvdts8nOJRJN3OWDUoyWxBf7kbu9DBPE=",
+			body:    body,
+			wantErr: "illegal digest value for \"sha-256\" in \"Content-Digest\" header",
+		},
+		{
+			name:    "no dictionary",
+			header:  "X48E9qOokqqrvdts8nOJRJN3OWDUoyWxBf7kbu9DBPE",
+			body:    body,
+			wantErr: "illegal digest \"X48E9qOokqqrvdts8nOJRJN3OWDUoyWxBf7kbu9DBPE\" in \"Content-Digest\" header",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := verifyContentDigest(tt.header, tt.body)
+			if tt.wantErr == "" {
+				require.NoError(t, err)
+				return
+			}
+			require.EqualError(t, err, tt.wantErr)
+		})
+	}
+}
@@ -6,7 +6,16 @@ the request.
 
 A Dex is used to get a user from a request who is identified by a bearer token.
 We use a dex backend to load the keys from our service so we can verify the
-signature of the JWT token. It is up to the client to get a correct bearer
-token.
+signature of the JWT token. The keys are fetched from "<baseurl>/keys" or, with
+the Discovery option, from the jwks_uri of the openid configuration. It is up to
+the client to get a correct bearer token.
+
+HTTPSigSigner and HTTPSigVerifier implement the standardized http message
+signatures of RFC 9421, so tools which are not written in go can
+authenticate without implementing the HMACAuth scheme.
+
+Services which speak gRPC or Connect use the interceptors of this package,
+which pass the metadata of a call to any UserGetter and put the user into the
+context of the handler.
 */
 package security
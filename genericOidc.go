@@ -2,6 +2,7 @@ package security
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"net/http"
 	"time"
@@ -22,6 +23,24 @@ type GenericOIDCClaims struct {
 	EMail             string   `json:"email"`
 	Roles             []string `json:"roles,omitempty"`
 	Groups            []string `json:"groups,omitempty"`
+
+	raw map[string]any
+}
+
+// UnmarshalJSON implements the json.Unmarshaler, all claims are kept so they
+// can be read with Project.
+func (g *GenericOIDCClaims) UnmarshalJSON(data []byte) error {
+	type claims GenericOIDCClaims
+	if err := json.Unmarshal(data, (*claims)(g)); err != nil {
+		return err
+	}
+	return json.Unmarshal(data, &g.raw)
+}
+
+// Project returns the value of the first of the given claims which is a non
+// empty string.
+func (g *GenericOIDCClaims) Project(names ...string) string {
+	return stringClaim(g.raw, names)
 }
 
 func (g *GenericOIDCClaims) Username() string {
@@ -43,6 +62,7 @@ func (g *GenericOIDCClaims) Memberships() []string {
 type GenericOIDC struct {
 	issuerConfig    *IssuerConfig
 	userExtractorFn GenericUserExtractorFn
+	projectClaims   []string
 	provider        *oidc.Provider
 	verifier        *oidc.IDTokenVerifier
 }
@@ -52,6 +72,12 @@ type GenericOIDCCfg struct {
 	SupportedSigningAlgs []string
 	Timeout              time.Duration
 	UserExtractorFn      GenericUserExtractorFn
+	// ProjectClaims are the claims which contain the project of the user, the
+	// first one which is set wins.
+	ProjectClaims []string
+	// MinKeyRefreshInterval is the minimum interval between two fetches of the
+	// keys which are caused by tokens with unknown key ids.
+	MinKeyRefreshInterval time.Duration
 }
 
 // NewGenericOIDC creates a new GenericOIDC.
@@ -61,6 +87,9 @@ func NewGenericOIDC(ic *IssuerConfig, opts ...GenericOIDCOption) (*GenericOIDC,
 		UserExtractorFn:      DefaultGenericUserExtractor,
 		Timeout:              10 * time.Second,
 		SupportedSigningAlgs: []string{"RS256", "RS384", "RS512"},
+		ProjectClaims:        []string{"project"},
+
+		MinKeyRefreshInterval: minKeyRefreshInterval,
 	}
 
 	for _, opt := range opts {
@@ -81,7 +110,15 @@ func NewGenericOIDC(ic *IssuerConfig, opts ...GenericOIDCOption) (*GenericOIDC,
 		return nil, err
 	}
 
-	verifier := provider.Verifier(&oidc.Config{
+	var meta struct {
+		Issuer  string `json:"issuer"`
+		JWKSURL string `json:"jwks_uri"`
+	}
+	if err := provider.Claims(&meta); err != nil {
+		return nil, err
+	}
+	keySet := newOIDCKeySet(meta.JWKSURL, client, cfg.MinKeyRefreshInterval)
+	verifier := oidc.NewVerifier(meta.Issuer, keySet, &oidc.Config{
 		ClientID:             ic.ClientID,
 		SupportedSigningAlgs: cfg.SupportedSigningAlgs,
 		SkipClientIDCheck:    false,
@@ -93,6 +130,7 @@ func NewGenericOIDC(ic *IssuerConfig, opts ...GenericOIDCOption) (*GenericOIDC,
 	g := &GenericOIDC{
 		issuerConfig:    ic,
 		userExtractorFn: cfg.UserExtractorFn,
+		projectClaims:   cfg.ProjectClaims,
 		provider:        provider,
 		verifier:        verifier,
 	}
@@ -100,8 +138,22 @@ func NewGenericOIDC(ic *IssuerConfig, opts ...GenericOIDCOption) (*GenericOIDC,
 	return g, nil
 }
 
-// User implements the UserGetter to get a user from the request.
+// User implements the UserGetter to get a user from the request. All errors
+// are of the type *AuthError.
 func (o *GenericOIDC) User(rq *http.Request) (*User, error) {
+	u, err := o.user(rq)
+	if err != nil {
+		kind := AuthErrorInvalidCredentials
+		var expired *oidc.TokenExpiredError
+		if errors.As(err, &expired) {
+			kind = AuthErrorExpired
+		}
+		return nil, newAuthError("oidc:"+o.issuerConfig.Issuer, kind, err)
+	}
+	return u, nil
+}
+
+func (o *GenericOIDC) user(rq *http.Request) (*User, error) {
 
 	ctx := context.Background()
 
@@ -126,6 +178,9 @@ func (o *GenericOIDC) User(rq *http.Request) (*User, error) {
 	if err != nil {
 		return nil, err
 	}
+	if u != nil && u.Project == "" {
+		u.Project = claims.Project(o.projectClaims...)
+	}
 
 	return u, nil
 }
@@ -146,6 +201,24 @@ func Timeout(timeout time.Duration) GenericOIDCOption {
 	}
 }
 
+// GenericProjectClaims sets the claims which contain the project of the user,
+// the default is "project". The project is only set if the
+// GenericUserExtractorFn did not set one.
+func GenericProjectClaims(names ...string) GenericOIDCOption {
+	return func(o *GenericOIDCCfg) {
+		o.ProjectClaims = names
+	}
+}
+
+// GenericMinKeyRefreshInterval sets the minimum interval between two fetches
+// of the keys which are caused by tokens with unknown key ids, the default is
+// 10 seconds. Concurrent fetches are always coalesced.
+func GenericMinKeyRefreshInterval(d time.Duration) GenericOIDCOption {
+	return func(o *GenericOIDCCfg) {
+		o.MinKeyRefreshInterval = d
+	}
+}
+
 // GenericUserExtractorFn extracts the User and Claims
 type GenericUserExtractorFn func(ic *IssuerConfig, claims *GenericOIDCClaims) (*User, error)
 
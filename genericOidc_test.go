@@ -11,6 +11,7 @@ import (
 	"github.com/google/go-cmp/cmp"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 
 	"github.com/go-jose/go-jose/v4"
 )
@@ -253,3 +254,39 @@ func TestGenericOIDC_User(t *testing.T) {
 		})
 	}
 }
+
+func TestGenericOIDC_UserProject(t *testing.T) {
+	tests := []struct {
+		name   string
+		claims map[string]any
+		opts   []GenericOIDCOption
+		want   string
+	}{
+		{name: "no project claim"},
+		{name: "default project claim", claims: map[string]any{"project": "p1"}, want: "p1"},
+		{
+			name:   "configured project claims",
+			claims: map[string]any{"project": "p1", "https://metal-stack.io/project": "p2"},
+			opts:   []GenericOIDCOption{GenericProjectClaims("https://metal-stack.io/project", "project")},
+			want:   "p2",
+		},
+		{name: "project is no string", claims: map[string]any{"project": 42}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tc := DefaultTokenCfg()
+			tc.ExtraClaims = tt.claims
+			srv, token, err := GenerateTokenAndKeyServer(tc, func(cfg *TokenCfg) (string, jose.JSONWebKey, jose.JSONWebKey) {
+				return MustCreateTokenAndKeys(cfg)
+			})
+			require.NoError(t, err)
+			defer srv.Close()
+
+			o, err := NewGenericOIDC(&IssuerConfig{Tenant: "Tn", Issuer: srv.URL, ClientID: "metal-stack"}, tt.opts...)
+			require.NoError(t, err)
+			u, err := o.User(&http.Request{Header: createHeader(AuthzHeaderKey, "Bearer "+token)})
+			require.NoError(t, err)
+			require.Equal(t, tt.want, u.Project)
+		})
+	}
+}
@@ -0,0 +1,119 @@
+package security
+
+import (
+	"fmt"
+	"strings"
+)
+
+// GrantAll is the wildcard of a Grant, e.g. the group "Tn_k8s-all-all-cadm"
+// grants the role "cadm" in all clusters and all namespaces of the tenant "Tn".
+const GrantAll = "all"
+
+// GrantAny is only used in a wanted Grant and matches every value of the
+// groups of a user, e.g. Grant{Tenant: "Tn", Application: GrantAny, Cluster:
+// GrantAny, Namespace: GrantAny, Role: "view"} asks if the user may view
+// anything of the tenant "Tn". It is never parsed from a group.
+const GrantAny = "*"
+
+// A Grant is the structured form of a group which follows the metal-stack
+// naming convention "<tenant>_<application>-<cluster>-<namespace>-<role>".
+type Grant struct {
+	Tenant      string
+	Application string
+	Cluster     string
+	Namespace   string
+	Role        string
+}
+
+// ParseGrant parses a group into a Grant. The tenant is separated by the first
+// underscore, the application, the cluster and the role must not contain
+// dashes, everything between the cluster and the role is the namespace.
+func ParseGrant(group ResourceAccess) (Grant, error) {
+	tenant, rest, ok := strings.Cut(string(group), "_")
+	if !ok || tenant == "" {
+		return Grant{}, fmt.Errorf("group %q has no tenant", group)
+	}
+	parts := strings.Split(rest, "-")
+	if len(parts) < 4 {
+		return Grant{}, fmt.Errorf("group %q does not match <tenant>_<application>-<cluster>-<namespace>-<role>", group)
+	}
+	g := Grant{
+		Tenant:      tenant,
+		Application: parts[0],
+		Cluster:     parts[1],
+		Namespace:   strings.Join(parts[2:len(parts)-1], "-"),
+		Role:        parts[len(parts)-1],
+	}
+	for _, f := range []string{g.Tenant, g.Application, g.Cluster, g.Namespace, g.Role} {
+		if f == "" {
+			return Grant{}, fmt.Errorf("group %q has empty parts", group)
+		}
+		if f == GrantAny {
+			return Grant{}, fmt.Errorf("group %q must not contain %q", group, GrantAny)
+		}
+	}
+	return g, nil
+}
+
+// Group returns the group of the Grant.
+func (g Grant) Group() ResourceAccess {
+	return ResourceAccess(g.Tenant + "_" + g.Application + "-" + g.Cluster + "-" + g.Namespace + "-" + g.Role)
+}
+
+func (g Grant) String() string {
+	return string(g.Group())
+}
+
+// Covers returns true if this Grant includes the wanted one. A part of this
+// Grant which is GrantAll covers every value. A part of the wanted Grant which
+// is GrantAll asks for all values, so it is only covered by GrantAll, to ask
+// for any value use GrantAny. A wanted Grant with an empty part is never
+// covered, so a missing value does not grant access.
+func (g Grant) Covers(want Grant) bool {
+	return grantPartCovers(g.Tenant, want.Tenant) &&
+		grantPartCovers(g.Application, want.Application) &&
+		grantPartCovers(g.Cluster, want.Cluster) &&
+		grantPartCovers(g.Namespace, want.Namespace) &&
+		grantPartCovers(g.Role, want.Role)
+}
+
+func grantPartCovers(have, want string) bool {
+	switch {
+	case want == "":
+		return false
+	case want == GrantAny:
+		return true
+	default:
+		return have == GrantAll || have == want
+	}
+}
+
+// Grants returns the groups of the user which follow the naming convention of a
+// Grant, other groups are ignored.
+func (u *User) Grants() []Grant {
+	if u == nil {
+		return nil
+	}
+	var grants []Grant
+	for _, grp := range u.Groups {
+		g, err := ParseGrant(grp)
+		if err != nil {
+			continue
+		}
+		grants = append(grants, g)
+	}
+	return grants
+}
+
+// HasGrant returns true if at least one group of the user covers the wanted
+// Grant, e.g. the user has the role "cadm" in all namespaces of the cluster "c1"
+// of the tenant "Tn" if HasGrant(Grant{Tenant: "Tn", Application: "k8s",
+// Cluster: "c1", Namespace: GrantAll, Role: "cadm"}) is true.
+func (u *User) HasGrant(want Grant) bool {
+	for _, g := range u.Grants() {
+		if g.Covers(want) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,112 @@
+package security
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseGrant(t *testing.T) {
+	tests := []struct {
+		name    string
+		group   ResourceAccess
+		want    Grant
+		wantErr string
+	}{
+		{
+			name:  "default token",
+			group: "Tn_k8s-all-all-cadm",
+			want:  Grant{Tenant: "Tn", Application: "k8s", Cluster: "all", Namespace: "all", Role: "cadm"},
+		},
+		{
+			name:  "namespace with dashes",
+			group: "Tn_k8s-c1-kube-system-view",
+			want:  Grant{Tenant: "Tn", Application: "k8s", Cluster: "c1", Namespace: "kube-system", Role: "view"},
+		},
+		{
+			name:  "underscore in the rest",
+			group: "Tn_k8s-c1-my_ns-edit",
+			want:  Grant{Tenant: "Tn", Application: "k8s", Cluster: "c1", Namespace: "my_ns", Role: "edit"},
+		},
+		{
+			name:    "no tenant",
+			group:   "kaas-view",
+			wantErr: `group "kaas-view" has no tenant`,
+		},
+		{
+			name:    "too short",
+			group:   "development__cluster-admin",
+			wantErr: `group "development__cluster-admin" does not match <tenant>_<application>-<cluster>-<namespace>-<role>`,
+		},
+		{
+			name:    "empty parts",
+			group:   "Tn_k8s--all-cadm",
+			wantErr: `group "Tn_k8s--all-cadm" has empty parts`,
+		},
+		{
+			name:    "any is not parsed",
+			group:   "Tn_k8s-*-all-cadm",
+			wantErr: `group "Tn_k8s-*-all-cadm" must not contain "*"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseGrant(tt.group)
+			if tt.wantErr != "" {
+				require.EqualError(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.want, got)
+			require.Equal(t, tt.group, got.Group())
+		})
+	}
+}
+
+func TestUser_HasGrant(t *testing.T) {
+	u := &User{Groups: []ResourceAccess{
+		"Tn_k8s-all-all-cadm",
+		"Other_k8s-c1-default-view",
+		"kaas-view",
+	}}
+
+	require.Equal(t, []Grant{
+		{Tenant: "Tn", Application: "k8s", Cluster: "all", Namespace: "all", Role: "cadm"},
+		{Tenant: "Other", Application: "k8s", Cluster: "c1", Namespace: "default", Role: "view"},
+	}, u.Grants())
+
+	tests := []struct {
+		name string
+		want Grant
+		ok   bool
+	}{
+		{name: "admin on cluster of tenant", want: Grant{Tenant: "Tn", Application: "k8s", Cluster: "c1", Namespace: GrantAll, Role: "cadm"}, ok: true},
+		{name: "admin on namespace of tenant", want: Grant{Tenant: "Tn", Application: "k8s", Cluster: "c1", Namespace: "kube-system", Role: "cadm"}, ok: true},
+		{name: "admin on any application of tenant", want: Grant{Tenant: "Tn", Application: GrantAny, Cluster: "c1", Namespace: GrantAny, Role: "cadm"}, ok: true},
+		{name: "other role of tenant", want: Grant{Tenant: "Tn", Application: GrantAny, Cluster: GrantAny, Namespace: GrantAny, Role: "view"}},
+		{name: "view on namespace", want: Grant{Tenant: "Other", Application: "k8s", Cluster: "c1", Namespace: "default", Role: "view"}, ok: true},
+		{name: "view on other namespace", want: Grant{Tenant: "Other", Application: "k8s", Cluster: "c1", Namespace: "kube-system", Role: "view"}},
+		{name: "view on all namespaces", want: Grant{Tenant: "Other", Application: "k8s", Cluster: "c1", Namespace: GrantAll, Role: "view"}},
+		{name: "view on any namespace", want: Grant{Tenant: "Other", Application: "k8s", Cluster: "c1", Namespace: GrantAny, Role: "view"}, ok: true},
+		{name: "admin of all tenants", want: Grant{Tenant: GrantAll, Application: "k8s", Cluster: GrantAll, Namespace: GrantAll, Role: "cadm"}},
+		{name: "admin of any tenant", want: Grant{Tenant: GrantAny, Application: GrantAny, Cluster: GrantAny, Namespace: GrantAny, Role: "cadm"}, ok: true},
+		{name: "unknown tenant", want: Grant{Tenant: "Unknown", Application: GrantAny, Cluster: GrantAny, Namespace: GrantAny, Role: "cadm"}},
+		{name: "empty tenant", want: Grant{Application: GrantAny, Cluster: GrantAny, Namespace: GrantAny, Role: "cadm"}},
+		{name: "empty role", want: Grant{Tenant: "Tn", Application: "k8s", Cluster: "c1", Namespace: "default"}},
+		{name: "empty grant", want: Grant{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.ok, u.HasGrant(tt.want))
+		})
+	}
+
+	// a wanted grant which is parsed from a group asks for all values literally
+	viewer := &User{Groups: []ResourceAccess{"Tn_k8s-c1-default-view"}}
+	want, err := ParseGrant("Tn_k8s-c1-all-view")
+	require.NoError(t, err)
+	require.False(t, viewer.HasGrant(want))
+
+	var nobody *User
+	require.False(t, nobody.HasGrant(Grant{Tenant: "Tn"}))
+}
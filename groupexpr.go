@@ -0,0 +1,297 @@
+package security
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"unicode"
+)
+
+// A GroupExpr is a boolean expression over the groups and attributes of a
+// User, e.g. "admin OR (viewer AND tenant=foo)". A term is either a group or an
+// attribute of the form "tenant=<tenant>", "project=<project>" or
+// "issuer=<issuer>". Terms are combined with NOT, AND and OR, which bind in
+// this order, and can be grouped with parentheses. The operators are case
+// insensitive.
+//
+// A GroupExpr implements the encoding.TextUnmarshaler, so it can be used in
+// configuration files. A nil or zero GroupExpr, e.g. of an expression which is
+// missing in a configuration file, matches no user, so a forgotten requirement
+// denies access instead of granting it.
+type GroupExpr struct {
+	root groupNode
+}
+
+// ParseGroupExpr parses the given expression.
+func ParseGroupExpr(expr string) (*GroupExpr, error) {
+	p := &groupExprParser{expr: expr, tokens: tokenizeGroupExpr(expr)}
+	if len(p.tokens) == 0 {
+		return nil, fmt.Errorf("cannot parse group expression %q: expression is empty", expr)
+	}
+	root, err := p.or()
+	if err == nil && p.pos < len(p.tokens) {
+		err = p.errorf("unexpected %q", p.tokens[p.pos].text)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &GroupExpr{root: root}, nil
+}
+
+// MustParseGroupExpr parses the given expression and panics on errors.
+func MustParseGroupExpr(expr string) *GroupExpr {
+	e, err := ParseGroupExpr(expr)
+	if err != nil {
+		panic(err)
+	}
+	return e
+}
+
+// Match returns true if the user matches the expression. Anonymous users only
+// match expressions which do not require a group or an attribute. A nil or zero
+// GroupExpr matches no user.
+func (e *GroupExpr) Match(u *User) bool {
+	if e == nil || e.root == nil {
+		return false
+	}
+	if u == nil {
+		u = &User{}
+	}
+	return e.root.match(u)
+}
+
+// Require returns a middleware which responds with http.StatusForbidden if the
+// user of the request does not match the expression.
+func (e *GroupExpr) Require(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, rq *http.Request) {
+		u := GetUser(rq)
+		if !e.Match(u) {
+			name := ""
+			if u != nil {
+				name = u.Name
+			}
+			http.Error(w, fmt.Sprintf("user %q does not match %q", name, e.String()), http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, rq)
+	})
+}
+
+func (e *GroupExpr) String() string {
+	if e == nil || e.root == nil {
+		return ""
+	}
+	return e.root.String()
+}
+
+// MarshalText implements the encoding.TextMarshaler.
+func (e *GroupExpr) MarshalText() ([]byte, error) {
+	return []byte(e.String()), nil
+}
+
+// UnmarshalText implements the encoding.TextUnmarshaler.
+func (e *GroupExpr) UnmarshalText(text []byte) error {
+	parsed, err := ParseGroupExpr(string(text))
+	if err != nil {
+		return err
+	}
+	*e = *parsed
+	return nil
+}
+
+type groupNode interface {
+	match(u *User) bool
+	String() string
+}
+
+type groupTerm ResourceAccess
+
+func (g groupTerm) match(u *User) bool {
+	return u.HasGroup(ResourceAccess(g))
+}
+
+func (g groupTerm) String() string {
+	return string(g)
+}
+
+type attributeTerm struct {
+	name  string
+	value string
+}
+
+var groupExprAttributes = map[string]func(u *User) string{
+	"tenant":  func(u *User) string { return u.Tenant },
+	"project": func(u *User) string { return u.Project },
+	"issuer":  func(u *User) string { return u.Issuer },
+}
+
+func (a attributeTerm) match(u *User) bool {
+	return groupExprAttributes[a.name](u) == a.value
+}
+
+func (a attributeTerm) String() string {
+	return a.name + "=" + a.value
+}
+
+type notNode struct {
+	node groupNode
+}
+
+func (n notNode) match(u *User) bool {
+	return !n.node.match(u)
+}
+
+func (n notNode) String() string {
+	return "NOT " + n.node.String()
+}
+
+type binaryNode struct {
+	op          string
+	left, right groupNode
+}
+
+func (b binaryNode) match(u *User) bool {
+	if b.op == "AND" {
+		return b.left.match(u) && b.right.match(u)
+	}
+	return b.left.match(u) || b.right.match(u)
+}
+
+func (b binaryNode) String() string {
+	return "(" + b.left.String() + " " + b.op + " " + b.right.String() + ")"
+}
+
+type groupExprToken struct {
+	text string
+	pos  int
+}
+
+// tokenizeGroupExpr splits the expression into parentheses and words.
+func tokenizeGroupExpr(expr string) []groupExprToken {
+	var (
+		tokens []groupExprToken
+		start  = -1
+	)
+	flush := func(end int) {
+		if start >= 0 {
+			tokens = append(tokens, groupExprToken{text: expr[start:end], pos: start})
+			start = -1
+		}
+	}
+	for i, r := range expr {
+		switch {
+		case r == '(' || r == ')':
+			flush(i)
+			tokens = append(tokens, groupExprToken{text: string(r), pos: i})
+		case unicode.IsSpace(r):
+			flush(i)
+		case start < 0:
+			start = i
+		}
+	}
+	flush(len(expr))
+	return tokens
+}
+
+// groupExprParser is a recursive descent parser for:
+//
+//	or   = and { "OR" and }
+//	and  = not { "AND" not }
+//	not  = "NOT" not | term
+//	term = "(" or ")" | group | attribute "=" value
+type groupExprParser struct {
+	expr   string
+	tokens []groupExprToken
+	pos    int
+}
+
+func (p *groupExprParser) errorf(format string, args ...any) error {
+	pos := len(p.expr)
+	if p.pos < len(p.tokens) {
+		pos = p.tokens[p.pos].pos
+	}
+	return fmt.Errorf("cannot parse group expression %q: %s at position %d", p.expr, fmt.Sprintf(format, args...), pos)
+}
+
+func (p *groupExprParser) keyword(kw string) bool {
+	if p.pos < len(p.tokens) && strings.EqualFold(p.tokens[p.pos].text, kw) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *groupExprParser) or() (groupNode, error) {
+	left, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("OR") {
+		right, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		left = binaryNode{op: "OR", left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *groupExprParser) and() (groupNode, error) {
+	left, err := p.not()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("AND") {
+		right, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		left = binaryNode{op: "AND", left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *groupExprParser) not() (groupNode, error) {
+	if p.keyword("NOT") {
+		n, err := p.not()
+		if err != nil {
+			return nil, err
+		}
+		return notNode{node: n}, nil
+	}
+	return p.term()
+}
+
+func (p *groupExprParser) term() (groupNode, error) {
+	if p.pos >= len(p.tokens) {
+		return nil, p.errorf("unexpected end of expression")
+	}
+	tok := p.tokens[p.pos]
+	switch {
+	case tok.text == "(":
+		p.pos++
+		n, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if !p.keyword(")") {
+			return nil, p.errorf("missing %q", ")")
+		}
+		return n, nil
+	case tok.text == ")", strings.EqualFold(tok.text, "AND"), strings.EqualFold(tok.text, "OR"):
+		return nil, p.errorf("unexpected %q", tok.text)
+	}
+	name, value, ok := strings.Cut(tok.text, "=")
+	if !ok {
+		p.pos++
+		return groupTerm(tok.text), nil
+	}
+	if _, known := groupExprAttributes[name]; !known {
+		return nil, p.errorf("unknown attribute %q", name)
+	}
+	if value == "" {
+		return nil, p.errorf("attribute %q has no value", name)
+	}
+	p.pos++
+	return attributeTerm{name: name, value: value}, nil
+}
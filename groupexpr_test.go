@@ -0,0 +1,165 @@
+package security
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseGroupExpr(t *testing.T) {
+	admin := &User{Name: "admin", Groups: []ResourceAccess{"admin"}}
+	fooViewer := &User{Name: "fv", Tenant: "foo", Groups: []ResourceAccess{"viewer"}}
+	barViewer := &User{Name: "bv", Tenant: "bar", Project: "p1", Groups: []ResourceAccess{"viewer", "blocked"}}
+
+	tests := []struct {
+		name    string
+		expr    string
+		want    string
+		matches []*User
+		wantErr string
+	}{
+		{
+			name:    "single group",
+			expr:    "admin",
+			want:    "admin",
+			matches: []*User{admin},
+		},
+		{
+			name:    "or with and",
+			expr:    "admin OR (viewer AND tenant=foo)",
+			want:    "(admin OR (viewer AND tenant=foo))",
+			matches: []*User{admin, fooViewer},
+		},
+		{
+			name:    "and binds stronger",
+			expr:    "admin or viewer and tenant=foo",
+			want:    "(admin OR (viewer AND tenant=foo))",
+			matches: []*User{admin, fooViewer},
+		},
+		{
+			name:    "not",
+			expr:    "viewer AND NOT blocked",
+			want:    "(viewer AND NOT blocked)",
+			matches: []*User{fooViewer},
+		},
+		{
+			name:    "project",
+			expr:    "project=p1",
+			want:    "project=p1",
+			matches: []*User{barViewer},
+		},
+		{
+			name:    "group names with special characters",
+			expr:    "(Tn_k8s-all-all-cadm)",
+			want:    "Tn_k8s-all-all-cadm",
+			matches: []*User{},
+		},
+		{
+			name:    "empty",
+			expr:    "  ",
+			wantErr: `cannot parse group expression "  ": expression is empty`,
+		},
+		{
+			name:    "missing operand",
+			expr:    "admin OR",
+			wantErr: `cannot parse group expression "admin OR": unexpected end of expression at position 8`,
+		},
+		{
+			name:    "missing operator",
+			expr:    "admin viewer",
+			wantErr: `cannot parse group expression "admin viewer": unexpected "viewer" at position 6`,
+		},
+		{
+			name:    "unbalanced parentheses",
+			expr:    "(admin OR viewer",
+			wantErr: `cannot parse group expression "(admin OR viewer": missing ")" at position 16`,
+		},
+		{
+			name:    "closing parenthesis",
+			expr:    "admin)",
+			wantErr: `cannot parse group expression "admin)": unexpected ")" at position 5`,
+		},
+		{
+			name:    "leading operator",
+			expr:    "AND admin",
+			wantErr: `cannot parse group expression "AND admin": unexpected "AND" at position 0`,
+		},
+		{
+			name:    "unknown attribute",
+			expr:    "admin OR email=a@b.c",
+			wantErr: `cannot parse group expression "admin OR email=a@b.c": unknown attribute "email" at position 9`,
+		},
+		{
+			name:    "attribute without value",
+			expr:    "tenant=",
+			wantErr: `cannot parse group expression "tenant=": attribute "tenant" has no value at position 0`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e, err := ParseGroupExpr(tt.expr)
+			if tt.wantErr != "" {
+				require.EqualError(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.want, e.String())
+			for _, u := range []*User{admin, fooViewer, barViewer, &guest, nil} {
+				require.Equal(t, slices.Contains(tt.matches, u), e.Match(u), "user %v", u)
+			}
+		})
+	}
+}
+
+func TestGroupExpr_UnmarshalText(t *testing.T) {
+	var cfg struct {
+		Routes map[string]*GroupExpr `json:"routes"`
+	}
+	err := json.Unmarshal([]byte(`{"routes":{"/admin":"admin OR (viewer AND tenant=foo)"}}`), &cfg)
+	require.NoError(t, err)
+	require.True(t, cfg.Routes["/admin"].Match(&User{Tenant: "foo", Groups: []ResourceAccess{"viewer"}}))
+
+	out, err := json.Marshal(cfg)
+	require.NoError(t, err)
+	require.JSONEq(t, `{"routes":{"/admin":"(admin OR (viewer AND tenant=foo))"}}`, string(out))
+
+	err = json.Unmarshal([]byte(`{"routes":{"/admin":"admin AND"}}`), &cfg)
+	require.EqualError(t, err, `cannot parse group expression "admin AND": unexpected end of expression at position 9`)
+}
+
+func TestGroupExpr_Require(t *testing.T) {
+	h := MustParseGroupExpr("admin").Require(http.HandlerFunc(func(w http.ResponseWriter, rq *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	rq := httptest.NewRequest(http.MethodGet, "/", nil)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, rq.WithContext(PutUserInContext(rq.Context(), &User{Name: "a", Groups: []ResourceAccess{"admin"}})))
+	require.Equal(t, http.StatusNoContent, rec.Code)
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, rq.WithContext(PutUserInContext(rq.Context(), &User{Name: "v", Groups: []ResourceAccess{"viewer"}})))
+	require.Equal(t, http.StatusForbidden, rec.Code)
+	require.Equal(t, "user \"v\" does not match \"admin\"\n", rec.Body.String())
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, rq.WithContext(PutUserInContext(rq.Context(), nil)))
+	require.Equal(t, http.StatusForbidden, rec.Code)
+	require.Equal(t, "user \"\" does not match \"admin\"\n", rec.Body.String())
+
+	require.Panics(t, func() { MustParseGroupExpr("(") })
+
+	// an expression which is missing in the configuration denies access
+	admin := &User{Name: "a", Groups: []ResourceAccess{"admin"}}
+	for _, e := range []*GroupExpr{nil, {}} {
+		require.False(t, e.Match(admin))
+		require.Empty(t, e.String())
+		rec = httptest.NewRecorder()
+		e.Require(http.NotFoundHandler()).ServeHTTP(rec, rq.WithContext(PutUserInContext(rq.Context(), admin)))
+		require.Equal(t, http.StatusForbidden, rec.Code)
+	}
+}
@@ -0,0 +1,139 @@
+package security
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// UnaryServerInterceptor returns a grpc interceptor which authenticates the
+// calls with the given UserGetter and puts the user into the context of the
+// handler. Calls which cannot be authenticated are rejected with the code
+// Unauthenticated.
+func UnaryServerInterceptor(ug UserGetter) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		ctx, err := grpcUser(ctx, ug, info.FullMethod)
+		if err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+// StreamServerInterceptor returns a grpc interceptor which authenticates the
+// streams with the given UserGetter and puts the user into the context of the
+// stream.
+func StreamServerInterceptor(ug UserGetter) grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx, err := grpcUser(ss.Context(), ug, info.FullMethod)
+		if err != nil {
+			return err
+		}
+		return handler(srv, &authenticatedServerStream{ServerStream: ss, ctx: ctx})
+	}
+}
+
+// UnaryClientInterceptor returns a grpc interceptor which adds the given
+// credentials to the metadata of the calls.
+func UnaryClientInterceptor(creds ClientCredentials) grpc.UnaryClientInterceptor {
+	return func(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		ctx, err := grpcCredentials(ctx, creds, method, cc)
+		if err != nil {
+			return err
+		}
+		return invoker(ctx, method, req, reply, cc, opts...)
+	}
+}
+
+// StreamClientInterceptor returns a grpc interceptor which adds the given
+// credentials to the metadata of the streams.
+func StreamClientInterceptor(creds ClientCredentials) grpc.StreamClientInterceptor {
+	return func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+		ctx, err := grpcCredentials(ctx, creds, method, cc)
+		if err != nil {
+			return nil, err
+		}
+		return streamer(ctx, desc, cc, method, opts...)
+	}
+}
+
+type authenticatedServerStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *authenticatedServerStream) Context() context.Context {
+	return s.ctx
+}
+
+// grpcUser authenticates a call with the incoming metadata. The host of the
+// request is taken from the ":authority" pseudo header.
+func grpcUser(ctx context.Context, ug UserGetter, method string) (context.Context, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	var host string
+	header := make(http.Header, len(md))
+	for k, vs := range md {
+		if k == ":authority" && len(vs) > 0 {
+			host = vs[0]
+			continue
+		}
+		for _, v := range vs {
+			header.Add(k, v)
+		}
+	}
+	ctx, err := rpcUser(ctx, ug, method, host, header)
+	if err != nil {
+		code := codes.Unauthenticated
+		var ae *AuthError
+		if errors.As(err, &ae) && ae.Kind == AuthErrorUnavailable {
+			code = codes.Unavailable
+		}
+		return nil, status.Error(code, err.Error())
+	}
+	return ctx, nil
+}
+
+// grpcCredentials adds the credentials to the outgoing metadata.
+func grpcCredentials(ctx context.Context, creds ClientCredentials, method string, cc *grpc.ClientConn) (context.Context, error) {
+	md, _ := metadata.FromOutgoingContext(ctx)
+	header := make(http.Header, len(md))
+	for k, vs := range md {
+		for _, v := range vs {
+			header.Add(k, v)
+		}
+	}
+	headers, err := creds(rpcRequestData(method, grpcAuthority(cc), header))
+	if err != nil {
+		return nil, fmt.Errorf("cannot create credentials: %w", err)
+	}
+	kv := make([]string, 0, 2*len(headers))
+	for k, v := range headers {
+		kv = append(kv, strings.ToLower(k), v)
+	}
+	return metadata.AppendToOutgoingContext(ctx, kv...), nil
+}
+
+// grpcAuthority returns the authority grpc uses by default for the target of the
+// connection, e.g. "localhost:50051" for "dns:///localhost:50051". It does not
+// know about an authority which was set with grpc.WithAuthority.
+func grpcAuthority(cc *grpc.ClientConn) string {
+	if cc == nil {
+		return ""
+	}
+	u, err := url.Parse(cc.CanonicalTarget())
+	if err != nil {
+		return cc.Target()
+	}
+	if u.Scheme == "unix" || u.Scheme == "unix-abstract" {
+		return "localhost"
+	}
+	return strings.TrimPrefix(u.Path, "/")
+}
@@ -0,0 +1,145 @@
+package security
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// userHealthServer answers with the status SERVING only for the given user.
+type userHealthServer struct {
+	healthpb.UnimplementedHealthServer
+	user string
+}
+
+func (h *userHealthServer) status(ctx context.Context) healthpb.HealthCheckResponse_ServingStatus {
+	if GetUserFromContext(ctx).Name == h.user {
+		return healthpb.HealthCheckResponse_SERVING
+	}
+	return healthpb.HealthCheckResponse_NOT_SERVING
+}
+
+func (h *userHealthServer) Check(ctx context.Context, _ *healthpb.HealthCheckRequest) (*healthpb.HealthCheckResponse, error) {
+	return &healthpb.HealthCheckResponse{Status: h.status(ctx)}, nil
+}
+
+func (h *userHealthServer) Watch(_ *healthpb.HealthCheckRequest, stream grpc.ServerStreamingServer[healthpb.HealthCheckResponse]) error {
+	return stream.Send(&healthpb.HealthCheckResponse{Status: h.status(stream.Context())})
+}
+
+func TestGRPCInterceptors(t *testing.T) {
+	useRandomSalt(t)
+	u := User{Name: "Bicycle Repair Man"}
+	server := NewHMACAuth("mytype", []byte{1, 2, 3}, WithUser(u), WithCanonicalRequest("x-request-id"))
+	creds := NewCreds(WithHMAC(server))
+
+	lis := bufconn.Listen(1024 * 1024)
+	srv := grpc.NewServer(
+		grpc.UnaryInterceptor(UnaryServerInterceptor(creds)),
+		grpc.StreamInterceptor(StreamServerInterceptor(creds)),
+	)
+	healthpb.RegisterHealthServer(srv, &userHealthServer{user: u.Name})
+	go func() { _ = srv.Serve(lis) }()
+	defer srv.Stop()
+
+	dial := func(t *testing.T, c ClientCredentials) healthpb.HealthClient {
+		conn, err := grpc.NewClient("passthrough:///bufnet",
+			grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+			grpc.WithTransportCredentials(insecure.NewCredentials()),
+			grpc.WithUnaryInterceptor(UnaryClientInterceptor(c)),
+			grpc.WithStreamInterceptor(StreamClientInterceptor(c)),
+		)
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = conn.Close() })
+		return healthpb.NewHealthClient(conn)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	t.Run("hmac", func(t *testing.T) {
+		client := dial(t, HMACCredentials(NewHMACAuth("mytype", []byte{1, 2, 3}, WithCanonicalRequest("x-request-id"))))
+
+		rsp, err := client.Check(ctx, &healthpb.HealthCheckRequest{})
+		require.NoError(t, err)
+		require.Equal(t, healthpb.HealthCheckResponse_SERVING, rsp.Status)
+
+		stream, err := client.Watch(ctx, &healthpb.HealthCheckRequest{})
+		require.NoError(t, err)
+		rsp, err = stream.Recv()
+		require.NoError(t, err)
+		require.Equal(t, healthpb.HealthCheckResponse_SERVING, rsp.Status)
+	})
+
+	t.Run("wrong key", func(t *testing.T) {
+		client := dial(t, HMACCredentials(NewHMACAuth("mytype", []byte{4, 5, 6}, WithCanonicalRequest("x-request-id"))))
+
+		_, err := client.Check(ctx, &healthpb.HealthCheckRequest{})
+		require.Equal(t, codes.Unauthenticated, status.Code(err))
+
+		stream, err := client.Watch(ctx, &healthpb.HealthCheckRequest{})
+		require.NoError(t, err)
+		_, err = stream.Recv()
+		require.Equal(t, codes.Unauthenticated, status.Code(err))
+	})
+
+	t.Run("guest", func(t *testing.T) {
+		client := dial(t, BearerCredentials(StaticToken("")))
+		// there is no bearer auther, so the token is ignored
+		rsp, err := client.Check(ctx, &healthpb.HealthCheckRequest{})
+		require.NoError(t, err)
+		require.Equal(t, healthpb.HealthCheckResponse_NOT_SERVING, rsp.Status)
+	})
+
+	t.Run("body digest", func(t *testing.T) {
+		client := dial(t, HMACCredentials(NewHMACAuth("mytype", []byte{1, 2, 3}, WithBodyDigest())))
+		_, err := client.Check(ctx, &healthpb.HealthCheckRequest{})
+		require.ErrorContains(t, err, "the body of a rpc cannot be signed")
+	})
+}
+
+// bearerUserGetter returns a user for the bearer token "my-token".
+type bearerUserGetter struct{}
+
+func (bearerUserGetter) User(rq *http.Request) (*User, error) {
+	if rq.Header.Get(AuthzHeaderKey) != "Bearer my-token" {
+		return nil, errors.New("wrong token")
+	}
+	return &User{Name: "Bicycle Repair Man"}, nil
+}
+
+func TestGRPCInterceptors_Bearer(t *testing.T) {
+	var got *User
+	handler := func(ctx context.Context, req any) (any, error) {
+		got = GetUserFromContext(ctx)
+		return nil, nil
+	}
+	info := &grpc.UnaryServerInfo{FullMethod: "/grpc.health.v1.Health/Check"}
+
+	ctx, err := grpcCredentials(context.Background(), BearerCredentials(StaticToken("my-token")), info.FullMethod, nil)
+	require.NoError(t, err)
+	md, ok := metadata.FromOutgoingContext(ctx)
+	require.True(t, ok)
+
+	_, err = UnaryServerInterceptor(bearerUserGetter{})(metadata.NewIncomingContext(context.Background(), md), nil, info, handler)
+	require.NoError(t, err)
+	require.Equal(t, "Bicycle Repair Man", got.Name)
+
+	_, err = UnaryServerInterceptor(bearerUserGetter{})(context.Background(), nil, info, handler)
+	require.Equal(t, codes.Unauthenticated, status.Code(err))
+	require.Equal(t, "wrong token", status.Convert(err).Message())
+
+	_, err = grpcCredentials(context.Background(), BearerCredentials(func() (string, error) { return "", errors.New("expired") }), info.FullMethod, nil)
+	require.EqualError(t, err, "cannot create credentials: expired")
+}
@@ -0,0 +1,533 @@
+package security
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// The header names of RFC 9421 http message signatures.
+const (
+	SignatureHeaderKey      = "Signature"
+	SignatureInputHeaderKey = "Signature-Input"
+)
+
+// The algorithms of the RFC 9421 http message signatures which are supported.
+const (
+	HTTPSigHMACSHA256       = "hmac-sha256"
+	HTTPSigEd25519          = "ed25519"
+	HTTPSigECDSAP256SHA256  = "ecdsa-p256-sha256"
+	HTTPSigRSAPSSSHA512     = "rsa-pss-sha512"
+	defaultHTTPSigLabel     = "sig1"
+	defaultHTTPSigMaxAge    = 5 * time.Minute
+	defaultHTTPSigClockSkew = 10 * time.Second
+)
+
+var (
+	defaultHTTPSigComponents         = []string{"@method", "@authority", "@path", "@query", "content-digest"}
+	defaultHTTPSigRequiredComponents = []string{"@method", "@authority", "@path", "@query"}
+)
+
+// A HTTPSigKey is a key for http message signatures. The Key depends on the
+// algorithm:
+//
+//   - hmac-sha256: the shared secret as []byte
+//   - ed25519: a ed25519.PrivateKey to sign or a ed25519.PublicKey to verify
+//   - ecdsa-p256-sha256: a *ecdsa.PrivateKey to sign or a *ecdsa.PublicKey to verify
+//   - rsa-pss-sha512: a *rsa.PrivateKey to sign or a *rsa.PublicKey to verify
+type HTTPSigKey struct {
+	ID        string
+	Algorithm string
+	Key       any
+	// User is returned by the HTTPSigVerifier if a request is signed with this key.
+	User *User
+}
+
+// httpSigConfig is the configuration which is shared by the HTTPSigSigner and
+// the HTTPSigVerifier.
+type httpSigConfig struct {
+	label      string
+	components []string
+	// componentsSet is true if the components were explicitly configured
+	componentsSet bool
+	maxAge        time.Duration
+	maxBodySize   int64
+	now           func() time.Time
+}
+
+// HTTPSigOption configures a HTTPSigSigner or a HTTPSigVerifier.
+type HTTPSigOption func(*httpSigConfig)
+
+// WithSignatureLabel sets the label of the signature. The signer uses "sig1" by
+// default, the verifier accepts every label by default.
+func WithSignatureLabel(label string) HTTPSigOption {
+	return func(c *httpSigConfig) {
+		c.label = label
+	}
+}
+
+// WithSignatureComponents sets the components which are covered by the
+// signature. The signer signs "@method", "@authority", "@path", "@query" and
+// "content-digest" by default. The verifier requires "@method", "@authority",
+// "@path" and "@query" by default and "content-digest" if the request has
+// content, if this option is set, exactly the given components are required.
+func WithSignatureComponents(components ...string) HTTPSigOption {
+	return func(c *httpSigConfig) {
+		c.components = components
+		c.componentsSet = true
+	}
+}
+
+// WithSignatureMaxAge sets the maximum age of the "created" parameter of a
+// signature which is accepted by the verifier, the default is five minutes.
+func WithSignatureMaxAge(maxAge time.Duration) HTTPSigOption {
+	return func(c *httpSigConfig) {
+		c.maxAge = maxAge
+	}
+}
+
+// WithSignatureMaxBodySize sets the limit of the body which the verifier reads
+// to check its digest, the default is DefaultMaxBodySize. The body is only read
+// after the signature was verified.
+func WithSignatureMaxBodySize(n int64) HTTPSigOption {
+	return func(c *httpSigConfig) {
+		c.maxBodySize = n
+	}
+}
+
+func newHTTPSigConfig(opts []HTTPSigOption) *httpSigConfig {
+	cfg := &httpSigConfig{
+		maxAge:      defaultHTTPSigMaxAge,
+		maxBodySize: DefaultMaxBodySize,
+		now:         time.Now,
+	}
+	for _, o := range opts {
+		o(cfg)
+	}
+	return cfg
+}
+
+// HTTPSigSigner signs requests with RFC 9421 http message signatures.
+type HTTPSigSigner struct {
+	key HTTPSigKey
+	cfg *httpSigConfig
+}
+
+// NewHTTPSigSigner returns a new signer which signs requests with the given key.
+func NewHTTPSigSigner(key HTTPSigKey, opts ...HTTPSigOption) (*HTTPSigSigner, error) {
+	if err := checkHTTPSigKey(key, true); err != nil {
+		return nil, err
+	}
+	cfg := newHTTPSigConfig(opts)
+	if cfg.label == "" {
+		cfg.label = defaultHTTPSigLabel
+	}
+	if !cfg.componentsSet {
+		cfg.components = defaultHTTPSigComponents
+	}
+	return &HTTPSigSigner{key: key, cfg: cfg}, nil
+}
+
+// Sign adds the "Signature-Input" and "Signature" headers to the request. If
+// "content-digest" is covered, the digest of the given body is added too, so
+// the body must be the content which is sent with the request.
+func (s *HTTPSigSigner) Sign(rq *http.Request, body []byte) error {
+	if slices.Contains(s.cfg.components, "content-digest") {
+		rq.Header.Set(DigestHeaderKey, contentDigest(body))
+	}
+	params := sfParams{
+		{key: "created", value: s.cfg.now().Unix()},
+		{key: "keyid", value: s.key.ID},
+		{key: "alg", value: s.key.Algorithm},
+	}
+	base, sigParams, err := signatureBase(rq, s.cfg.components, params)
+	if err != nil {
+		return err
+	}
+	sig, err := signHTTPSig(s.key, base)
+	if err != nil {
+		return err
+	}
+	rq.Header.Set(SignatureInputHeaderKey, s.cfg.label+"="+sigParams)
+	rq.Header.Set(SignatureHeaderKey, s.cfg.label+"=:"+base64.StdEncoding.EncodeToString(sig)+":")
+	return nil
+}
+
+// HTTPSigVerifier is a UserGetter which verifies RFC 9421 http message
+// signatures and returns the user which is connected to the signing key.
+type HTTPSigVerifier struct {
+	keys map[string]HTTPSigKey
+	cfg  *httpSigConfig
+}
+
+// NewHTTPSigVerifier returns a new verifier which accepts signatures of the
+// given keys.
+func NewHTTPSigVerifier(keys []HTTPSigKey, opts ...HTTPSigOption) (*HTTPSigVerifier, error) {
+	v := &HTTPSigVerifier{
+		keys: make(map[string]HTTPSigKey),
+		cfg:  newHTTPSigConfig(opts),
+	}
+	for _, k := range keys {
+		if err := checkHTTPSigKey(k, false); err != nil {
+			return nil, err
+		}
+		if _, ok := v.keys[k.ID]; ok {
+			return nil, fmt.Errorf("duplicate key id %q", k.ID)
+		}
+		v.keys[k.ID] = k
+	}
+	return v, nil
+}
+
+// User implements the UserGetter to get a user from the request. The first
+// signature whose key id is known to the verifier is verified, signatures of
+// unknown keys are ignored. All errors are of the type *AuthError.
+func (v *HTTPSigVerifier) User(rq *http.Request) (*User, error) {
+	u, err := v.user(rq)
+	if err != nil {
+		return nil, newAuthError("httpsig", AuthErrorInvalidCredentials, err)
+	}
+	return u, nil
+}
+
+func (v *HTTPSigVerifier) user(rq *http.Request) (*User, error) {
+	inputHeader := strings.Join(rq.Header.Values(SignatureInputHeaderKey), ", ")
+	sigHeader := strings.Join(rq.Header.Values(SignatureHeaderKey), ", ")
+	if inputHeader == "" || sigHeader == "" {
+		return nil, errNoAuthFound
+	}
+	inputs, err := parseSFDictionary(inputHeader)
+	if err != nil {
+		return nil, &AuthError{Kind: AuthErrorMalformed, Err: fmt.Errorf("illegal %q header: %w", SignatureInputHeaderKey, err)}
+	}
+	sigs, err := parseSFDictionary(sigHeader)
+	if err != nil {
+		return nil, &AuthError{Kind: AuthErrorMalformed, Err: fmt.Errorf("illegal %q header: %w", SignatureHeaderKey, err)}
+	}
+
+	for _, input := range inputs {
+		if v.cfg.label != "" && input.key != v.cfg.label {
+			continue
+		}
+		keyID, _ := input.params.get("keyid")
+		id, ok := keyID.(string)
+		if !ok {
+			continue
+		}
+		key, ok := v.keys[id]
+		if !ok {
+			continue
+		}
+		if !input.isList {
+			return nil, fmt.Errorf("the signature input %q is no inner list", input.key)
+		}
+		var sig []byte
+		for _, s := range sigs {
+			if s.key == input.key {
+				sig, _ = s.item.([]byte)
+			}
+		}
+		if sig == nil {
+			return nil, fmt.Errorf("no signature found for %q", input.key)
+		}
+		if err := v.verify(rq, key, input, sig); err != nil {
+			return nil, err
+		}
+		u := key.User
+		if u == nil {
+			u = &guest
+		}
+		// lets return a copy of our user so the caller cannot change it
+		newuser := *u
+		newuser.anonymous = false
+		return &newuser, nil
+	}
+	return nil, errUnknownAuthFound
+}
+
+func (v *HTTPSigVerifier) verify(rq *http.Request, key HTTPSigKey, input sfMember, sig []byte) error {
+	if alg, ok := input.params.get("alg"); ok && alg != key.Algorithm {
+		return fmt.Errorf("the algorithm %q does not match the key %q", alg, key.ID)
+	}
+
+	now := v.cfg.now()
+	created, _ := input.params.get("created")
+	c, ok := created.(int64)
+	if !ok {
+		return errors.New("the signature has no created parameter")
+	}
+	createdAt := time.Unix(c, 0)
+	if v.cfg.maxAge > 0 && now.Sub(createdAt) > v.cfg.maxAge {
+		return &AuthError{Kind: AuthErrorExpired, Err: fmt.Errorf("the signature was created at %s and is too old", createdAt.UTC().Format(time.RFC3339))}
+	}
+	if createdAt.Sub(now) > defaultHTTPSigClockSkew {
+		return &AuthError{Kind: AuthErrorExpired, Err: fmt.Errorf("the signature was created at %s which is in the future", createdAt.UTC().Format(time.RFC3339))}
+	}
+	if expires, ok := input.params.get("expires"); ok {
+		if e, ok := expires.(int64); !ok || now.After(time.Unix(e, 0)) {
+			return &AuthError{Kind: AuthErrorExpired, Err: errors.New("the signature is expired")}
+		}
+	}
+
+	required := v.cfg.components
+	if !v.cfg.componentsSet {
+		required = defaultHTTPSigRequiredComponents
+		if rq.ContentLength != 0 {
+			required = append(slices.Clone(required), "content-digest")
+		}
+	}
+	for _, c := range required {
+		if !slices.Contains(input.list, c) {
+			return fmt.Errorf("the component %q must be signed", c)
+		}
+	}
+
+	digest := rq.Header.Get(DigestHeaderKey)
+	if slices.Contains(input.list, "content-digest") && digest == "" {
+		return fmt.Errorf("no %q header found", DigestHeaderKey)
+	}
+
+	base, _, err := signatureBase(rq, input.list, input.params)
+	if err != nil {
+		return err
+	}
+	if err := verifyHTTPSig(key, base, sig); err != nil {
+		return err
+	}
+
+	// the digest is signed, so the body is only read if the signature is valid
+	if slices.Contains(input.list, "content-digest") {
+		body, err := readBody(rq, v.cfg.maxBodySize)
+		if err != nil {
+			return err
+		}
+		if err := verifyContentDigest(digest, body); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// signatureBase creates the signature base of RFC 9421, section 2.5 and the
+// serialized signature parameters.
+func signatureBase(rq *http.Request, components []string, params sfParams) ([]byte, string, error) {
+	var buf bytes.Buffer
+	for _, c := range components {
+		if c == "@signature-params" {
+			return nil, "", errors.New("the component \"@signature-params\" must not be covered")
+		}
+		v, err := componentValue(rq, c)
+		if err != nil {
+			return nil, "", err
+		}
+		buf.WriteString("\"" + c + "\": " + v + "\n")
+	}
+	sigParams, err := serializeSFInnerList(components, params)
+	if err != nil {
+		return nil, "", err
+	}
+	buf.WriteString("\"@signature-params\": " + sigParams)
+	return buf.Bytes(), sigParams, nil
+}
+
+// componentValue returns the value of a derived component or a header of the
+// request. It works for client requests and for requests received by a server.
+func componentValue(rq *http.Request, component string) (string, error) {
+	scheme := rq.URL.Scheme
+	if scheme == "" {
+		scheme = "http"
+		if rq.TLS != nil {
+			scheme = "https"
+		}
+	}
+	authority := strings.ToLower(requestHost(rq))
+	path := rq.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	query := "?" + rq.URL.RawQuery
+
+	switch component {
+	case "@method":
+		return rq.Method, nil
+	case "@target-uri":
+		return scheme + "://" + authority + rq.URL.RequestURI(), nil
+	case "@authority":
+		return authority, nil
+	case "@scheme":
+		return scheme, nil
+	case "@request-target":
+		return rq.URL.RequestURI(), nil
+	case "@path":
+		return path, nil
+	case "@query":
+		return query, nil
+	}
+	if strings.HasPrefix(component, "@") {
+		return "", fmt.Errorf("the component %q is not supported", component)
+	}
+	if component != strings.ToLower(component) {
+		return "", fmt.Errorf("the component %q must be lowercase", component)
+	}
+	values := rq.Header.Values(component)
+	if len(values) == 0 {
+		return "", fmt.Errorf("the header %q is signed but not present", component)
+	}
+	// the values are the slice of the header, so they must not be modified
+	trimmed := make([]string, len(values))
+	for i := range values {
+		trimmed[i] = strings.TrimSpace(values[i])
+	}
+	return strings.Join(trimmed, ", "), nil
+}
+
+// checkHTTPSigKey returns an error if the key cannot be used with its
+// algorithm, so signing and verifying never panic because of a nil key or a
+// key of the wrong size.
+func checkHTTPSigKey(key HTTPSigKey, private bool) error {
+	var ok bool
+	switch key.Algorithm {
+	case HTTPSigHMACSHA256:
+		var k []byte
+		k, ok = key.Key.([]byte)
+		ok = ok && len(k) > 0
+	case HTTPSigEd25519:
+		if private {
+			var k ed25519.PrivateKey
+			k, ok = key.Key.(ed25519.PrivateKey)
+			ok = ok && len(k) == ed25519.PrivateKeySize
+		} else {
+			var k ed25519.PublicKey
+			k, ok = key.Key.(ed25519.PublicKey)
+			ok = ok && len(k) == ed25519.PublicKeySize
+		}
+	case HTTPSigECDSAP256SHA256:
+		if private {
+			var k *ecdsa.PrivateKey
+			k, ok = key.Key.(*ecdsa.PrivateKey)
+			ok = ok && k != nil && k.D != nil && k.Curve == elliptic.P256()
+		} else {
+			var k *ecdsa.PublicKey
+			k, ok = key.Key.(*ecdsa.PublicKey)
+			ok = ok && k != nil && k.X != nil && k.Y != nil && k.Curve == elliptic.P256()
+		}
+	case HTTPSigRSAPSSSHA512:
+		if private {
+			var k *rsa.PrivateKey
+			k, ok = key.Key.(*rsa.PrivateKey)
+			ok = ok && k != nil && k.N != nil && k.D != nil
+		} else {
+			var k *rsa.PublicKey
+			k, ok = key.Key.(*rsa.PublicKey)
+			ok = ok && k != nil && k.N != nil
+		}
+	default:
+		return fmt.Errorf("unsupported algorithm %q for key %q", key.Algorithm, key.ID)
+	}
+	if !ok {
+		return fmt.Errorf("the key %q of type %T is not suitable for algorithm %q", key.ID, key.Key, key.Algorithm)
+	}
+	return nil
+}
+
+func signHTTPSig(key HTTPSigKey, base []byte) ([]byte, error) {
+	switch key.Algorithm {
+	case HTTPSigHMACSHA256:
+		h := hmac.New(sha256.New, key.Key.([]byte))
+		// a hash.Hash never returns an error on write
+		//nolint:errcheck
+		h.Write(base)
+		return h.Sum(nil), nil
+	case HTTPSigEd25519:
+		return ed25519.Sign(key.Key.(ed25519.PrivateKey), base), nil
+	case HTTPSigECDSAP256SHA256:
+		digest := sha256.Sum256(base)
+		r, s, err := ecdsa.Sign(rand.Reader, key.Key.(*ecdsa.PrivateKey), digest[:])
+		if err != nil {
+			return nil, err
+		}
+		// the signature is the concatenation of r and s with 32 bytes each
+		sig := make([]byte, 64)
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+		return sig, nil
+	case HTTPSigRSAPSSSHA512:
+		digest := sha512.Sum512(base)
+		return rsa.SignPSS(rand.Reader, key.Key.(*rsa.PrivateKey), crypto.SHA512, digest[:], &rsa.PSSOptions{SaltLength: 64})
+	default:
+		return nil, fmt.Errorf("unsupported algorithm %q", key.Algorithm)
+	}
+}
+
+func verifyHTTPSig(key HTTPSigKey, base, sig []byte) error {
+	var ok bool
+	switch key.Algorithm {
+	case HTTPSigHMACSHA256:
+		want, err := signHTTPSig(key, base)
+		if err != nil {
+			return err
+		}
+		ok = hmac.Equal(want, sig)
+	case HTTPSigEd25519:
+		ok = ed25519.Verify(key.Key.(ed25519.PublicKey), base, sig)
+	case HTTPSigECDSAP256SHA256:
+		if len(sig) != 64 {
+			return errors.New("the ecdsa signature must have 64 bytes")
+		}
+		digest := sha256.Sum256(base)
+		r := new(big.Int).SetBytes(sig[:32])
+		s := new(big.Int).SetBytes(sig[32:])
+		ok = ecdsa.Verify(key.Key.(*ecdsa.PublicKey), digest[:], r, s)
+	case HTTPSigRSAPSSSHA512:
+		digest := sha512.Sum512(base)
+		ok = rsa.VerifyPSS(key.Key.(*rsa.PublicKey), crypto.SHA512, digest[:], sig, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthAuto}) == nil
+	default:
+		return fmt.Errorf("unsupported algorithm %q", key.Algorithm)
+	}
+	if !ok {
+		return fmt.Errorf("the signature of key %q is invalid", key.ID)
+	}
+	return nil
+}
+
+// DefaultMaxBodySize is the default limit of the body which is read to verify
+// its digest.
+const DefaultMaxBodySize = 10 << 20
+
+// readBody reads the body of the request and replaces it by a buffered copy,
+// so later handlers can still consume it. If the body is larger than the limit,
+// an error is returned.
+func readBody(rq *http.Request, limit int64) ([]byte, error) {
+	if rq.Body == nil {
+		return nil, nil
+	}
+	if limit <= 0 {
+		limit = DefaultMaxBodySize
+	}
+	body, err := io.ReadAll(io.LimitReader(rq.Body, limit+1))
+	if err != nil {
+		return nil, fmt.Errorf("cannot read request body: %w", err)
+	}
+	if int64(len(body)) > limit {
+		return nil, &AuthError{Kind: AuthErrorMalformed, Err: fmt.Errorf("the request body is larger than %d bytes", limit)}
+	}
+	_ = rq.Body.Close()
+	rq.Body = io.NopCloser(bytes.NewReader(body))
+	return body, nil
+}
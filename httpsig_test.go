@@ -0,0 +1,361 @@
+package security
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// rfc9421Request returns the test request of RFC 9421, section 2.4.
+func rfc9421Request() *http.Request {
+	rq := httptest.NewRequest(http.MethodPost, "/foo?param=Value&Pet=dog", strings.NewReader(`{"hello": "world"}`))
+	rq.Host = "example.com"
+	rq.Header.Set("Date", "Tue, 20 Apr 2021 02:07:55 GMT")
+	rq.Header.Set("Content-Type", "application/json")
+	rq.Header.Set("Content-Digest", "sha-512=:WZDPaVn/7XgHaAy8pmojAkGWoRx2UFChF41A2svX+TaPm+AbwAgBWnrIiYllu7BNNyealdVLvRwEmTHWXvJwew==:")
+	rq.Header.Set("Content-Length", "18")
+	return rq
+}
+
+func TestHTTPSigVerifier_RFC9421(t *testing.T) {
+	created := time.Unix(1618884473, 0)
+	u := User{Name: "Bicycle Repair Man"}
+
+	secret, err := base64.StdEncoding.DecodeString("uzvJfB4u3N0Jy4T7NZ75MDVcr8zSTInedJtkgcu46YW4XByzNJjxBdtjUkdJPBtbmHhIDi6pcl8jsasjlTMtDQ==")
+	require.NoError(t, err)
+	der, err := base64.StdEncoding.DecodeString("MCowBQYDK2VwAyEAJrQLj5P/89iXES9+vFgrIy29clF9CC/oPPsw3c5D0bs=")
+	require.NoError(t, err)
+	edKey, err := x509.ParsePKIXPublicKey(der)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name      string
+		key       HTTPSigKey
+		input     string
+		signature string
+		wantErr   string
+	}{
+		{
+			name:      "B.2.5 hmac-sha256",
+			key:       HTTPSigKey{ID: "test-shared-secret", Algorithm: HTTPSigHMACSHA256, Key: secret, User: &u},
+			input:     `sig-b25=("date" "@authority" "content-type");created=1618884473;keyid="test-shared-secret"`,
+			signature: `sig-b25=:pxcQw6G3AjtMBQjwo8XzkZf/bws5LelbaMk5rGIGtE8=:`,
+		},
+		{
+			name:      "B.2.6 ed25519",
+			key:       HTTPSigKey{ID: "test-key-ed25519", Algorithm: HTTPSigEd25519, Key: edKey, User: &u},
+			input:     `sig-b26=("date" "@method" "@path" "@authority" "content-type" "content-length");created=1618884473;keyid="test-key-ed25519"`,
+			signature: `sig-b26=:wqcAqbmYJ2ji2glfAMaRy4gruYYnx2nEFN2HN6jrnDnQCK1u02Gb04v9EDgwUPiu4A0w6vuQv5lIp5WPpBKRCw==:`,
+		},
+		{
+			name:      "B.2.6 ed25519 with modified signature",
+			key:       HTTPSigKey{ID: "test-key-ed25519", Algorithm: HTTPSigEd25519, Key: edKey, User: &u},
+			input:     `sig-b26=("date" "@method" "@path" "@authority" "content-type" "content-length");created=1618884474;keyid="test-key-ed25519"`,
+			signature: `sig-b26=:wqcAqbmYJ2ji2glfAMaRy4gruYYnx2nEFN2HN6jrnDnQCK1u02Gb04v9EDgwUPiu4A0w6vuQv5lIp5WPpBKRCw==:`,
+			wantErr:   "the signature of key \"test-key-ed25519\" is invalid",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v, err := NewHTTPSigVerifier([]HTTPSigKey{tt.key}, WithSignatureComponents())
+			require.NoError(t, err)
+			v.cfg.now = func() time.Time { return created }
+
+			rq := rfc9421Request()
+			rq.Header.Set(SignatureInputHeaderKey, tt.input)
+			rq.Header.Set(SignatureHeaderKey, tt.signature)
+			got, err := v.User(rq)
+			if tt.wantErr != "" {
+				require.EqualError(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, u.Name, got.Name)
+		})
+	}
+}
+
+func TestHTTPSigSigner_Sign(t *testing.T) {
+	u := User{Name: "Bicycle Repair Man"}
+	edPub, edPriv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	keys := []struct {
+		signing      HTTPSigKey
+		verification HTTPSigKey
+	}{
+		{
+			signing:      HTTPSigKey{ID: "hmac", Algorithm: HTTPSigHMACSHA256, Key: []byte{1, 2, 3}},
+			verification: HTTPSigKey{ID: "hmac", Algorithm: HTTPSigHMACSHA256, Key: []byte{1, 2, 3}, User: &u},
+		},
+		{
+			signing:      HTTPSigKey{ID: "ed25519", Algorithm: HTTPSigEd25519, Key: edPriv},
+			verification: HTTPSigKey{ID: "ed25519", Algorithm: HTTPSigEd25519, Key: edPub, User: &u},
+		},
+		{
+			signing:      HTTPSigKey{ID: "ecdsa", Algorithm: HTTPSigECDSAP256SHA256, Key: ecKey},
+			verification: HTTPSigKey{ID: "ecdsa", Algorithm: HTTPSigECDSAP256SHA256, Key: &ecKey.PublicKey, User: &u},
+		},
+		{
+			signing:      HTTPSigKey{ID: "rsa", Algorithm: HTTPSigRSAPSSSHA512, Key: rsaKey},
+			verification: HTTPSigKey{ID: "rsa", Algorithm: HTTPSigRSAPSSSHA512, Key: &rsaKey.PublicKey, User: &u},
+		},
+	}
+
+	body := []byte(`{"name":"my-machine"}`)
+	tests := []struct {
+		name    string
+		opts    []HTTPSigOption
+		modify  func(rq *http.Request) *http.Request
+		wantErr string
+	}{
+		{
+			name: "correct usage",
+		},
+		{
+			name: "tampered path",
+			modify: func(rq *http.Request) *http.Request {
+				rq.URL.Path = "/v1/secret"
+				return rq
+			},
+			wantErr: "the signature of key \"%s\" is invalid",
+		},
+		{
+			name: "tampered body",
+			modify: func(rq *http.Request) *http.Request {
+				nrq := httptest.NewRequest(http.MethodPost, "/v1/machine?id=1", strings.NewReader(`{"name":"your-machine"}`))
+				nrq.Header = rq.Header
+				return nrq
+			},
+			wantErr: "the \"sha-256\" digest in \"Content-Digest\" header does not match the content",
+		},
+		{
+			name: "body not signed",
+			opts: []HTTPSigOption{WithSignatureComponents("@method", "@authority", "@path", "@query")},
+			modify: func(rq *http.Request) *http.Request {
+				rq.Header.Del(DigestHeaderKey)
+				return rq
+			},
+			wantErr: "the component \"content-digest\" must be signed",
+		},
+		{
+			name: "unknown key",
+			modify: func(rq *http.Request) *http.Request {
+				rq.Header.Set(SignatureInputHeaderKey, strings.Replace(rq.Header.Get(SignatureInputHeaderKey), "keyid=\"", "keyid=\"unknown-", 1))
+				return rq
+			},
+			wantErr: "unknown authtype found",
+		},
+		{
+			name: "no signature",
+			modify: func(rq *http.Request) *http.Request {
+				rq.Header.Del(SignatureHeaderKey)
+				return rq
+			},
+			wantErr: "no auth found",
+		},
+	}
+	for _, k := range keys {
+		for _, tt := range tests {
+			t.Run(k.signing.Algorithm+" "+tt.name, func(t *testing.T) {
+				s, err := NewHTTPSigSigner(k.signing, tt.opts...)
+				require.NoError(t, err)
+				v, err := NewHTTPSigVerifier([]HTTPSigKey{k.verification})
+				require.NoError(t, err)
+
+				rq := httptest.NewRequest(http.MethodPost, "/v1/machine?id=1", strings.NewReader(string(body)))
+				require.NoError(t, s.Sign(rq, body))
+				require.Contains(t, rq.Header.Get(SignatureInputHeaderKey), "sig1=(")
+				if tt.modify != nil {
+					rq = tt.modify(rq)
+				}
+
+				got, err := v.User(rq)
+				if tt.wantErr != "" {
+					wantErr := tt.wantErr
+					if strings.Contains(wantErr, "%s") {
+						wantErr = strings.ReplaceAll(wantErr, "%s", k.signing.ID)
+					}
+					require.EqualError(t, err, wantErr)
+					return
+				}
+				require.NoError(t, err)
+				require.Equal(t, u.Name, got.Name)
+
+				// the body must still be readable for the handler
+				b, err := io.ReadAll(rq.Body)
+				require.NoError(t, err)
+				require.Equal(t, body, b)
+			})
+		}
+	}
+}
+
+func TestHTTPSigSigner_KeepsHeaders(t *testing.T) {
+	key := HTTPSigKey{ID: "hmac", Algorithm: HTTPSigHMACSHA256, Key: []byte{1, 2, 3}}
+	s, err := NewHTTPSigSigner(key, WithSignatureComponents("@method", "@authority", "@path", "@query", "x-custom"))
+	require.NoError(t, err)
+	v, err := NewHTTPSigVerifier([]HTTPSigKey{key})
+	require.NoError(t, err)
+
+	rq := httptest.NewRequest(http.MethodGet, "/v1/machine", nil)
+	rq.Header.Add("X-Custom", "  a  ")
+	rq.Header.Add("X-Custom", "b ")
+	require.NoError(t, s.Sign(rq, nil))
+	require.Equal(t, []string{"  a  ", "b "}, rq.Header.Values("X-Custom"))
+
+	_, err = v.User(rq)
+	require.NoError(t, err)
+	require.Equal(t, []string{"  a  ", "b "}, rq.Header.Values("X-Custom"))
+}
+
+func TestHTTPSigVerifier_Created(t *testing.T) {
+	key := HTTPSigKey{ID: "hmac", Algorithm: HTTPSigHMACSHA256, Key: []byte{1, 2, 3}}
+	now := time.Now()
+
+	tests := []struct {
+		name    string
+		created time.Time
+		wantErr string
+	}{
+		{
+			name:    "recent",
+			created: now.Add(-time.Minute),
+		},
+		{
+			name:    "too old",
+			created: now.Add(-10 * time.Minute),
+			wantErr: "the signature was created at " + now.Add(-10*time.Minute).UTC().Format(time.RFC3339) + " and is too old",
+		},
+		{
+			name:    "in the future",
+			created: now.Add(time.Minute),
+			wantErr: "the signature was created at " + now.Add(time.Minute).UTC().Format(time.RFC3339) + " which is in the future",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := NewHTTPSigSigner(key)
+			require.NoError(t, err)
+			s.cfg.now = func() time.Time { return tt.created }
+			v, err := NewHTTPSigVerifier([]HTTPSigKey{key})
+			require.NoError(t, err)
+			v.cfg.now = func() time.Time { return now }
+
+			rq := httptest.NewRequest(http.MethodGet, "/v1/machine", nil)
+			require.NoError(t, s.Sign(rq, nil))
+			_, err = v.User(rq)
+			if tt.wantErr != "" {
+				require.EqualError(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestNewHTTPSigSigner_IllegalKey(t *testing.T) {
+	_, err := NewHTTPSigSigner(HTTPSigKey{ID: "k", Algorithm: HTTPSigEd25519, Key: []byte{1, 2, 3}})
+	require.EqualError(t, err, "the key \"k\" of type []uint8 is not suitable for algorithm \"ed25519\"")
+
+	_, err = NewHTTPSigVerifier([]HTTPSigKey{{ID: "k", Algorithm: "hmac-md5", Key: []byte{1, 2, 3}}})
+	require.EqualError(t, err, "unsupported algorithm \"hmac-md5\" for key \"k\"")
+
+	tests := []struct {
+		name    string
+		key     HTTPSigKey
+		private bool
+	}{
+		{name: "empty hmac key", key: HTTPSigKey{Algorithm: HTTPSigHMACSHA256, Key: []byte{}}, private: true},
+		{name: "short ed25519 private key", key: HTTPSigKey{Algorithm: HTTPSigEd25519, Key: ed25519.PrivateKey{1, 2, 3}}, private: true},
+		{name: "short ed25519 public key", key: HTTPSigKey{Algorithm: HTTPSigEd25519, Key: ed25519.PublicKey{1, 2, 3}}},
+		{name: "nil ecdsa private key", key: HTTPSigKey{Algorithm: HTTPSigECDSAP256SHA256, Key: (*ecdsa.PrivateKey)(nil)}, private: true},
+		{name: "nil ecdsa public key", key: HTTPSigKey{Algorithm: HTTPSigECDSAP256SHA256, Key: (*ecdsa.PublicKey)(nil)}},
+		{name: "empty ecdsa public key", key: HTTPSigKey{Algorithm: HTTPSigECDSAP256SHA256, Key: &ecdsa.PublicKey{Curve: elliptic.P256()}}},
+		{name: "nil rsa private key", key: HTTPSigKey{Algorithm: HTTPSigRSAPSSSHA512, Key: (*rsa.PrivateKey)(nil)}, private: true},
+		{name: "nil rsa public key", key: HTTPSigKey{Algorithm: HTTPSigRSAPSSSHA512, Key: (*rsa.PublicKey)(nil)}},
+		{name: "empty rsa public key", key: HTTPSigKey{Algorithm: HTTPSigRSAPSSSHA512, Key: &rsa.PublicKey{}}},
+		{name: "no key", key: HTTPSigKey{Algorithm: HTTPSigEd25519}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.key.ID = "k"
+			var err error
+			if tt.private {
+				_, err = NewHTTPSigSigner(tt.key)
+			} else {
+				_, err = NewHTTPSigVerifier([]HTTPSigKey{tt.key})
+			}
+			require.ErrorContains(t, err, "is not suitable for algorithm")
+		})
+	}
+}
+
+func TestHTTPSigVerifier_ReadsBodyAfterSignature(t *testing.T) {
+	key := HTTPSigKey{ID: "hmac", Algorithm: HTTPSigHMACSHA256, Key: []byte{1, 2, 3}}
+	signer, err := NewHTTPSigSigner(key)
+	require.NoError(t, err)
+	body := []byte(`{"name":"my-machine"}`)
+
+	tests := []struct {
+		name     string
+		opts     []HTTPSigOption
+		modify   func(rq *http.Request)
+		wantErr  string
+		wantRead bool
+	}{
+		{
+			name:    "invalid signature",
+			modify:  func(rq *http.Request) { rq.URL.Path = "/v1/secret" },
+			wantErr: `the signature of key "hmac" is invalid`,
+		},
+		{
+			name:     "body too large",
+			opts:     []HTTPSigOption{WithSignatureMaxBodySize(10)},
+			wantErr:  "the request body is larger than 10 bytes",
+			wantRead: true,
+		},
+		{
+			name:     "valid",
+			wantRead: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v, err := NewHTTPSigVerifier([]HTTPSigKey{key}, tt.opts...)
+			require.NoError(t, err)
+
+			rq := httptest.NewRequest(http.MethodPost, "http://example.com/v1/machine", strings.NewReader(string(body)))
+			require.NoError(t, signer.Sign(rq, body))
+			counter := &countingReader{r: strings.NewReader(string(body))}
+			rq.Body = io.NopCloser(counter)
+			if tt.modify != nil {
+				tt.modify(rq)
+			}
+
+			_, err = v.User(rq)
+			if tt.wantErr != "" {
+				require.EqualError(t, err, tt.wantErr)
+			} else {
+				require.NoError(t, err)
+			}
+			require.Equal(t, tt.wantRead, counter.read > 0)
+		})
+	}
+}
@@ -113,11 +113,20 @@ func IssuerRetryInterval(duration time.Duration) MultiIssuerUserGetterOption {
 	}
 }
 
+// User implements the UserGetter to get a user from the request. All errors
+// are of the type *AuthError.
 func (i *MultiIssuerCache) User(rq *http.Request) (*User, error) {
+	u, err := i.user(rq)
+	if err != nil {
+		return nil, newAuthError("issuercache", AuthErrorInvalidCredentials, err)
+	}
+	return u, nil
+}
 
+func (i *MultiIssuerCache) user(rq *http.Request) (*User, error) {
 	claims, err := ParseTokenClaimsUnvalidated(rq)
 	if err != nil {
-		return nil, err
+		return nil, newAuthError("issuercache", AuthErrorMalformed, err)
 	}
 
 	issuer := claims.Issuer
@@ -141,7 +150,7 @@ func (i *MultiIssuerCache) User(rq *http.Request) (*User, error) {
 	}
 
 	if iss == nil {
-		return nil, IssuerNotFound{}
+		return nil, &AuthError{Kind: AuthErrorUnknownIssuer, Err: IssuerNotFound{}}
 	}
 
 	i.log.Debug("found issuer", "issuer", iss)
@@ -166,7 +175,7 @@ func (i *MultiIssuerCache) User(rq *http.Request) (*User, error) {
 			i.updateCachedIssuer(iss)
 
 			// lazy initialization failed
-			return nil, err
+			return nil, &AuthError{Kind: AuthErrorUnavailable, Err: err}
 		}
 	}
 
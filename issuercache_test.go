@@ -521,3 +521,39 @@ func Test_IssuerOnceReset(t *testing.T) {
 	require.NoError(t, err)
 	assert.Equal(t, tc.Email, got.EMail, "email should be equal")
 }
+
+func TestMultiIssuerCache_UserAuthErrors(t *testing.T) {
+	ilp := func() ([]*IssuerConfig, error) {
+		return nil, nil
+	}
+	ugp := func(ic *IssuerConfig) (UserGetter, error) {
+		return nil, nil
+	}
+	ic, err := NewMultiIssuerCache(slog.New(slog.NewJSONHandler(os.Stdout, nil)), ilp, ugp)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name       string
+		authz      string
+		wantKind   AuthErrorKind
+		wantStatus int
+	}{
+		{name: "no token", wantKind: AuthErrorNoCredentials, wantStatus: http.StatusUnauthorized},
+		{name: "other scheme", authz: "Basic abc", wantKind: AuthErrorNoCredentials, wantStatus: http.StatusUnauthorized},
+		{name: "malformed token", authz: "Bearer abc", wantKind: AuthErrorMalformed, wantStatus: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rq := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tt.authz != "" {
+				rq.Header.Set(AuthzHeaderKey, tt.authz)
+			}
+			_, err := ic.User(rq)
+			var ae *AuthError
+			require.ErrorAs(t, err, &ae)
+			require.Equal(t, tt.wantKind, ae.Kind)
+			require.Equal(t, "issuercache", ae.Authenticator)
+			require.Equal(t, tt.wantStatus, ae.Status())
+		})
+	}
+}
@@ -0,0 +1,265 @@
+package security
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+)
+
+const (
+	// minKeyRefreshInterval is the default minimum interval between two
+	// refreshes of a key set which are forced by unknown key ids.
+	minKeyRefreshInterval = 10 * time.Second
+	// maxUnknownKeyIDs limits the number of unknown key ids which are cached.
+	maxUnknownKeyIDs = 1024
+	// maxCacheSeconds caps a max-age, so it does not overflow a time.Duration.
+	maxCacheSeconds = int64(100 * 365 * 24 * 60 * 60)
+)
+
+// keyRefresher coalesces and rate limits the refreshes of a key set which are
+// forced by tokens with unknown key ids, so tokens with random key ids do not
+// cause a fetch per request. Key ids which are still unknown after a
+// successful refresh are rejected without a refresh for the minimum interval.
+type keyRefresher struct {
+	minInterval time.Duration
+	now         func() time.Time
+
+	// lock serializes the fetches, generation is increased by every fetch, so
+	// callers which waited for a running fetch do not start another one
+	lock       sync.Mutex
+	generation atomic.Uint64
+	last       time.Time
+	lastErr    error
+
+	unknownLock sync.Mutex
+	unknown     map[string]time.Time
+}
+
+func newKeyRefresher(minInterval time.Duration) *keyRefresher {
+	return &keyRefresher{
+		minInterval: minInterval,
+		now:         time.Now,
+		unknown:     make(map[string]time.Time),
+	}
+}
+
+// refresh fetches the key set unconditionally, e.g. at a regular interval.
+func (r *keyRefresher) refresh(fetch func() error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.fetch(fetch)
+}
+
+// refreshUnknown fetches the key set because the given key id was not found in
+// the key set of the given generation. It returns false if the key set was not
+// fetched because the key id is known to be unknown or the last forced refresh
+// is too recent. If another caller fetched the key set in the meantime, it is
+// not fetched again. The error is the one of the fetch which loaded the
+// current key set.
+func (r *keyRefresher) refreshUnknown(kid string, seen uint64, fetch func() error) (bool, error) {
+	if r.isUnknown(kid) {
+		return false, nil
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.generation.Load() != seen {
+		return true, r.lastErr
+	}
+	now := r.now()
+	if !r.last.IsZero() && now.Sub(r.last) < r.minInterval {
+		return false, nil
+	}
+	r.last = now
+	r.fetch(fetch)
+	return true, r.lastErr
+}
+
+func (r *keyRefresher) fetch(fetch func() error) {
+	r.lastErr = fetch()
+	r.generation.Add(1)
+	r.unknownLock.Lock()
+	clear(r.unknown)
+	r.unknownLock.Unlock()
+}
+
+// markUnknown remembers that the key id was not found in a key set which was
+// fetched successfully. The key id is rejected without a refresh until the
+// minimum interval passed or the key set is fetched again.
+func (r *keyRefresher) markUnknown(kid string) {
+	r.unknownLock.Lock()
+	defer r.unknownLock.Unlock()
+	if len(r.unknown) >= maxUnknownKeyIDs {
+		clear(r.unknown)
+	}
+	r.unknown[kid] = r.now().Add(r.minInterval)
+}
+
+func (r *keyRefresher) isUnknown(kid string) bool {
+	r.unknownLock.Lock()
+	defer r.unknownLock.Unlock()
+	expires, ok := r.unknown[kid]
+	if ok && !r.now().Before(expires) {
+		delete(r.unknown, kid)
+		return false
+	}
+	return ok
+}
+
+// cacheMaxAge returns how long a response with the given headers may be
+// cached. The max-age of the Cache-Control header wins over the Expires header,
+// the age of the response is subtracted. If the response must not be cached,
+// the duration is zero. If there are no cache headers, false is returned.
+func cacheMaxAge(h http.Header, now time.Time) (time.Duration, bool) {
+	for directive := range strings.SplitSeq(strings.ToLower(strings.Join(h.Values("Cache-Control"), ",")), ",") {
+		name, value, _ := strings.Cut(strings.TrimSpace(directive), "=")
+		switch name {
+		case "no-store", "no-cache":
+			return 0, true
+		case "max-age":
+			seconds, err := strconv.ParseInt(strings.Trim(value, `"`), 10, 64)
+			if err != nil || seconds < 0 {
+				return 0, true
+			}
+			seconds = min(seconds, maxCacheSeconds)
+			age, _ := strconv.ParseInt(h.Get("Age"), 10, 64)
+			return max(time.Duration(seconds-max(age, 0))*time.Second, 0), true
+		}
+	}
+	expires := h.Get("Expires")
+	if expires == "" {
+		return 0, false
+	}
+	// an invalid date, e.g. "0", means already expired
+	t, err := http.ParseTime(expires)
+	if err != nil {
+		return 0, true
+	}
+	if date, err := http.ParseTime(h.Get("Date")); err == nil {
+		now = date
+	}
+	return max(t.Sub(now), 0), true
+}
+
+// allSigningAlgs are the algorithms a oidcKeySet can parse, the accepted
+// algorithms are checked by the oidc.IDTokenVerifier.
+var allSigningAlgs = []jose.SignatureAlgorithm{
+	jose.RS256, jose.RS384, jose.RS512,
+	jose.ES256, jose.ES384, jose.ES512,
+	jose.PS256, jose.PS384, jose.PS512,
+	jose.EdDSA,
+}
+
+// oidcKeySet implements the oidc.KeySet with the keys of a jwks url. Unlike the
+// oidc.RemoteKeySet, refreshes because of unknown key ids are rate limited by
+// a keyRefresher.
+type oidcKeySet struct {
+	jwksURL   string
+	client    *http.Client
+	refresher *keyRefresher
+
+	keys atomic.Pointer[oidcKeys]
+}
+
+type oidcKeys struct {
+	keys []jose.JSONWebKey
+	err  error
+}
+
+func newOIDCKeySet(jwksURL string, client *http.Client, minRefreshInterval time.Duration) *oidcKeySet {
+	return &oidcKeySet{
+		jwksURL:   jwksURL,
+		client:    client,
+		refresher: newKeyRefresher(minRefreshInterval),
+	}
+}
+
+// VerifySignature implements the oidc.KeySet.
+func (s *oidcKeySet) VerifySignature(ctx context.Context, jwt string) ([]byte, error) {
+	jws, err := jose.ParseSigned(jwt, allSigningAlgs)
+	if err != nil {
+		return nil, fmt.Errorf("oidc: malformed jwt: %w", err)
+	}
+	kid := ""
+	if len(jws.Signatures) > 0 {
+		kid = jws.Signatures[0].Header.KeyID
+	}
+	refreshed := false
+	for range 2 {
+		gen := s.refresher.generation.Load()
+		current := s.keys.Load()
+		if current != nil {
+			for _, key := range current.keys {
+				if kid == "" || key.KeyID == kid {
+					if payload, err := jws.Verify(&key); err == nil {
+						return payload, nil
+					}
+				}
+			}
+		}
+		ok, err := s.refresher.refreshUnknown(kid, gen, func() error { return s.fetch(ctx) })
+		if !ok {
+			break
+		}
+		refreshed = err == nil
+	}
+	if refreshed {
+		s.refresher.markUnknown(kid)
+	}
+	if current := s.keys.Load(); current != nil && current.err != nil {
+		return nil, fmt.Errorf("fetching keys %w", current.err)
+	}
+	return nil, errors.New("failed to verify id token signature")
+}
+
+// fetch loads the keys from the jwks url. On errors, the previous keys are
+// kept.
+func (s *oidcKeySet) fetch(ctx context.Context) error {
+	next := &oidcKeys{}
+	if current := s.keys.Load(); current != nil {
+		next.keys = current.keys
+	}
+	keys, err := s.fetchKeys(ctx)
+	if err != nil {
+		next.err = err
+	} else {
+		next.keys = keys
+	}
+	s.keys.Store(next)
+	return err
+}
+
+func (s *oidcKeySet) fetchKeys(ctx context.Context) ([]jose.JSONWebKey, error) {
+	rq, err := http.NewRequestWithContext(ctx, http.MethodGet, s.jwksURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("oidc: can't create request: %w", err)
+	}
+	rsp, err := s.client.Do(rq)
+	if err != nil {
+		return nil, fmt.Errorf("oidc: get keys failed %w", err)
+	}
+	defer func() {
+		_ = rsp.Body.Close()
+	}()
+	body, err := io.ReadAll(rsp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read response body: %w", err)
+	}
+	if rsp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("oidc: get keys failed: %s %s", rsp.Status, body)
+	}
+	var ks jose.JSONWebKeySet
+	if err := json.Unmarshal(body, &ks); err != nil {
+		return nil, fmt.Errorf("oidc: failed to decode keys: %w %s", err, body)
+	}
+	return ks.Keys, nil
+}
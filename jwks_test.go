@@ -0,0 +1,449 @@
+package security
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeyRefresher(t *testing.T) {
+	now := time.Date(2024, time.March, 1, 12, 0, 0, 0, time.UTC)
+	r := newKeyRefresher(10 * time.Second)
+	r.now = func() time.Time { return now }
+	fetches := 0
+	var fetchErr error
+	fetch := func() error {
+		fetches++
+		return fetchErr
+	}
+
+	ok, err := r.refreshUnknown("a", r.generation.Load(), fetch)
+	require.True(t, ok)
+	require.NoError(t, err)
+	require.Equal(t, 1, fetches)
+
+	// a caller which saw the old key set does not fetch again
+	ok, _ = r.refreshUnknown("a", 0, fetch)
+	require.True(t, ok)
+	require.Equal(t, 1, fetches)
+
+	// too early for another forced refresh
+	ok, _ = r.refreshUnknown("b", r.generation.Load(), fetch)
+	require.False(t, ok)
+	require.Equal(t, 1, fetches)
+
+	now = now.Add(11 * time.Second)
+	r.markUnknown("c")
+	ok, _ = r.refreshUnknown("c", r.generation.Load(), fetch)
+	require.False(t, ok)
+	require.Equal(t, 1, fetches)
+	ok, _ = r.refreshUnknown("b", r.generation.Load(), fetch)
+	require.True(t, ok)
+	require.Equal(t, 2, fetches)
+
+	// unknown key ids expire after the minimum interval
+	r.markUnknown("c")
+	require.True(t, r.isUnknown("c"))
+	now = now.Add(10 * time.Second)
+	require.False(t, r.isUnknown("c"))
+
+	// every refresh forgets the unknown key ids
+	r.markUnknown("c")
+	r.refresh(fetch)
+	require.Equal(t, 3, fetches)
+	require.False(t, r.isUnknown("c"))
+
+	// the error of the fetch is returned, also to callers which waited for it
+	now = now.Add(11 * time.Second)
+	fetchErr = errors.New("unavailable")
+	seen := r.generation.Load()
+	ok, err = r.refreshUnknown("d", seen, fetch)
+	require.True(t, ok)
+	require.EqualError(t, err, "unavailable")
+	ok, err = r.refreshUnknown("d", seen, fetch)
+	require.True(t, ok)
+	require.EqualError(t, err, "unavailable")
+	require.Equal(t, 4, fetches)
+
+	for i := range maxUnknownKeyIDs + 1 {
+		r.markUnknown(strings.Repeat("x", i))
+	}
+	require.Len(t, r.unknown, 1)
+}
+
+func TestKeyRefresher_Coalesce(t *testing.T) {
+	r := newKeyRefresher(0)
+	var (
+		fetches atomic.Int32
+		wg      sync.WaitGroup
+		started = make(chan struct{})
+		release = make(chan struct{})
+	)
+	fetch := func() error {
+		if fetches.Add(1) == 1 {
+			close(started)
+		}
+		<-release
+		return nil
+	}
+
+	gen := r.generation.Load()
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		r.refreshUnknown("a", gen, fetch)
+	}()
+	<-started
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ok, err := r.refreshUnknown("a", gen, fetch)
+			require.True(t, ok)
+			require.NoError(t, err)
+		}()
+	}
+	close(release)
+	wg.Wait()
+	require.Equal(t, int32(1), fetches.Load())
+}
+
+// keyServer returns a server which serves the given key set and counts the
+// requests for the keys.
+func keyServer(t *testing.T, pubKey jose.JSONWebKey) (*httptest.Server, *atomic.Int32) {
+	var fetches atomic.Int32
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, rq *http.Request) {
+		switch rq.URL.Path {
+		case "/.well-known/openid-configuration":
+			_ = json.NewEncoder(w).Encode(providerJSON{Issuer: srv.URL, JWKSURL: srv.URL + "/keys"})
+		case "/keys":
+			fetches.Add(1)
+			_ = json.NewEncoder(w).Encode(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{pubKey}})
+		default:
+			http.NotFound(w, rq)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &fetches
+}
+
+// signToken returns a token of the given issuer which is signed by the key.
+func signToken(t *testing.T, priv jose.JSONWebKey, issuer string) string {
+	token, err := CreateToken(MustMakeSigner(jose.RS256, priv), map[string]any{
+		"iss": issuer,
+		"aud": "metal-stack",
+		"sub": "achim",
+		"exp": time.Now().Add(time.Minute).Unix(),
+	})
+	require.NoError(t, err)
+	return token
+}
+
+// tokenWithKeyID returns a token which is signed by a new key with the given
+// key id.
+func tokenWithKeyID(t *testing.T, issuer, kid string) string {
+	_, priv, err := CreateWebkeyPair(jose.RS256, "sig", 0)
+	require.NoError(t, err)
+	priv.KeyID = kid
+	return signToken(t, priv, issuer)
+}
+
+func TestDex_UnknownKeyIDs(t *testing.T) {
+	pub, priv, err := CreateWebkeyPair(jose.RS256, "sig", 0)
+	require.NoError(t, err)
+	srv, fetches := keyServer(t, pub)
+
+	dx, err := NewDex(srv.URL)
+	require.NoError(t, err)
+	defer func() { _ = dx.Close() }()
+	require.Equal(t, int32(1), fetches.Load())
+
+	for i := range 20 {
+		rq := httptest.NewRequest(http.MethodGet, srv.URL, nil)
+		rq.Header.Add("Authorization", "Bearer "+tokenWithKeyID(t, srv.URL, "random-"+strings.Repeat("x", i%3)))
+		_, err := dx.User(rq)
+		require.ErrorContains(t, err, "not found")
+	}
+	// only the first unknown key id forces a refresh
+	require.Equal(t, int32(2), fetches.Load())
+
+	rq := httptest.NewRequest(http.MethodGet, srv.URL, nil)
+	rq.Header.Add("Authorization", "Bearer "+signToken(t, priv, srv.URL))
+	_, err = dx.User(rq)
+	require.NoError(t, err)
+	require.Equal(t, int32(2), fetches.Load())
+}
+
+func TestGenericOIDC_UnknownKeyIDs(t *testing.T) {
+	pub, priv, err := CreateWebkeyPair(jose.RS256, "sig", 0)
+	require.NoError(t, err)
+	srv, fetches := keyServer(t, pub)
+
+	o, err := NewGenericOIDC(&IssuerConfig{Tenant: "Tn", Issuer: srv.URL, ClientID: "metal-stack"})
+	require.NoError(t, err)
+	require.Equal(t, int32(0), fetches.Load())
+
+	// concurrent tokens with unknown key ids share one fetch
+	var wg sync.WaitGroup
+	for i := range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rq := &http.Request{Header: createHeader(AuthzHeaderKey, "Bearer "+tokenWithKeyID(t, srv.URL, "random-"+strings.Repeat("x", i%3)))}
+			_, err := o.User(rq)
+			require.ErrorContains(t, err, "failed to verify id token signature")
+		}()
+	}
+	wg.Wait()
+	require.Equal(t, int32(1), fetches.Load())
+
+	u, err := o.User(&http.Request{Header: createHeader(AuthzHeaderKey, "Bearer "+signToken(t, priv, srv.URL))})
+	require.NoError(t, err)
+	require.Equal(t, "achim", u.Subject)
+	require.Equal(t, int32(1), fetches.Load())
+
+	_, err = o.verifier.Verify(context.Background(), tokenWithKeyID(t, srv.URL, "another"))
+	require.ErrorContains(t, err, "failed to verify id token signature")
+	require.Equal(t, int32(1), fetches.Load())
+}
+
+func TestCacheMaxAge(t *testing.T) {
+	now := time.Date(2024, time.March, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name    string
+		header  http.Header
+		want    time.Duration
+		wantSet bool
+	}{
+		{name: "no cache headers"},
+		{
+			name:    "max-age",
+			header:  http.Header{"Cache-Control": {"public, max-age=300"}},
+			want:    5 * time.Minute,
+			wantSet: true,
+		},
+		{
+			name:    "max-age minus age",
+			header:  http.Header{"Cache-Control": {"max-age=300"}, "Age": {"100"}},
+			want:    200 * time.Second,
+			wantSet: true,
+		},
+		{
+			name:    "max-age wins over expires",
+			header:  http.Header{"Cache-Control": {"Max-Age=60"}, "Expires": {now.Add(time.Hour).Format(http.TimeFormat)}},
+			want:    time.Minute,
+			wantSet: true,
+		},
+		{
+			name:    "no-store",
+			header:  http.Header{"Cache-Control": {"no-store"}},
+			wantSet: true,
+		},
+		{
+			name:    "invalid max-age",
+			header:  http.Header{"Cache-Control": {"max-age=abc"}},
+			wantSet: true,
+		},
+		{
+			name:    "huge max-age",
+			header:  http.Header{"Cache-Control": {"max-age=99999999999999"}},
+			want:    time.Duration(maxCacheSeconds) * time.Second,
+			wantSet: true,
+		},
+		{
+			name:    "expires",
+			header:  http.Header{"Expires": {now.Add(time.Hour).Format(http.TimeFormat)}},
+			want:    time.Hour,
+			wantSet: true,
+		},
+		{
+			name: "expires relative to date",
+			header: http.Header{
+				"Expires": {now.Add(time.Hour).Format(http.TimeFormat)},
+				"Date":    {now.Add(30 * time.Minute).Format(http.TimeFormat)},
+			},
+			want:    30 * time.Minute,
+			wantSet: true,
+		},
+		{
+			name:    "expired",
+			header:  http.Header{"Expires": {"0"}},
+			wantSet: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := cacheMaxAge(tt.header, now)
+			require.Equal(t, tt.wantSet, ok)
+			require.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestDex_CacheHeaders(t *testing.T) {
+	pub, priv, err := CreateWebkeyPair(jose.RS256, "sig", 0)
+	require.NoError(t, err)
+	var (
+		fetches     atomic.Int32
+		notModified atomic.Int32
+		cache       atomic.Value
+	)
+	cache.Store("max-age=120")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, rq *http.Request) {
+		fetches.Add(1)
+		w.Header().Set("Cache-Control", cache.Load().(string))
+		w.Header().Set("ETag", `"v1"`)
+		if rq.Header.Get("If-None-Match") == `"v1"` {
+			notModified.Add(1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{pub}})
+	}))
+	defer srv.Close()
+
+	dx, err := NewDexWithContext(context.Background(), srv.URL, RefreshIntervalBounds(time.Minute, 2*time.Hour))
+	require.NoError(t, err)
+	defer func() { _ = dx.Close() }()
+	require.Equal(t, 2*time.Minute, dx.keys.Load().next)
+	require.Equal(t, `"v1"`, dx.keys.Load().etag)
+
+	// the keys did not change, so they are kept
+	dx.forceUpdate()
+	require.Equal(t, int32(2), fetches.Load())
+	require.Equal(t, int32(1), notModified.Load())
+	rq := httptest.NewRequest(http.MethodGet, srv.URL, nil)
+	rq.Header.Add("Authorization", "Bearer "+signToken(t, priv, srv.URL))
+	_, err = dx.User(rq)
+	require.NoError(t, err)
+
+	// the interval is bounded
+	cache.Store("max-age=5")
+	dx.forceUpdate()
+	require.Equal(t, time.Minute, dx.keys.Load().next)
+	cache.Store("max-age=86400")
+	dx.forceUpdate()
+	require.Equal(t, 2*time.Hour, dx.keys.Load().next)
+	cache.Store("")
+	dx.forceUpdate()
+	require.Equal(t, refetchInterval, dx.keys.Load().next)
+
+	// errors keep the keys and retry after the minimum interval
+	srv.Close()
+	dx.forceUpdate()
+	snap := dx.keys.Load()
+	require.Error(t, snap.err)
+	require.NotNil(t, snap.keys)
+	require.Equal(t, time.Minute, snap.next)
+	_, err = dx.User(rq)
+	require.NoError(t, err)
+}
+
+func TestDex_RefreshInBackground(t *testing.T) {
+	var fetches atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, rq *http.Request) {
+		fetches.Add(1)
+		w.Header().Set("Cache-Control", "max-age=0")
+		_ = json.NewEncoder(w).Encode(secondkeydata)
+	}))
+	defer srv.Close()
+
+	dx, err := NewDexWithContext(context.Background(), srv.URL, RefreshIntervalBounds(10*time.Millisecond, time.Second))
+	require.NoError(t, err)
+	defer func() { _ = dx.Close() }()
+
+	require.Eventually(t, func() bool { return fetches.Load() > 4 }, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestGenericOIDC_RecoverAfterFailedFetch(t *testing.T) {
+	pub, priv, err := CreateWebkeyPair(jose.RS256, "sig", 0)
+	require.NoError(t, err)
+	var (
+		fetches atomic.Int32
+		failing atomic.Bool
+		srv     *httptest.Server
+	)
+	failing.Store(true)
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, rq *http.Request) {
+		switch rq.URL.Path {
+		case "/.well-known/openid-configuration":
+			_ = json.NewEncoder(w).Encode(providerJSON{Issuer: srv.URL, JWKSURL: srv.URL + "/keys"})
+		case "/keys":
+			fetches.Add(1)
+			if failing.Load() {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			_ = json.NewEncoder(w).Encode(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{pub}})
+		}
+	}))
+	defer srv.Close()
+
+	o, err := NewGenericOIDC(&IssuerConfig{Tenant: "Tn", Issuer: srv.URL, ClientID: "metal-stack"}, GenericMinKeyRefreshInterval(50*time.Millisecond))
+	require.NoError(t, err)
+	rq := &http.Request{Header: createHeader(AuthzHeaderKey, "Bearer "+signToken(t, priv, srv.URL))}
+
+	_, err = o.User(rq)
+	require.ErrorContains(t, err, "fetching keys oidc: get keys failed: 500")
+	require.Equal(t, int32(1), fetches.Load())
+
+	// the failed fetch does not mark the key id as unknown
+	failing.Store(false)
+	require.Eventually(t, func() bool {
+		_, err := o.User(rq)
+		return err == nil
+	}, 5*time.Second, 20*time.Millisecond)
+	require.Equal(t, int32(2), fetches.Load())
+}
+
+func TestDex_RecoverAfterFailedFetch(t *testing.T) {
+	pub, priv, err := CreateWebkeyPair(jose.RS256, "sig", 0)
+	require.NoError(t, err)
+	other, _, err := CreateWebkeyPair(jose.RS256, "sig", 0)
+	require.NoError(t, err)
+	var (
+		fetches atomic.Int32
+		state   atomic.Int32
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, rq *http.Request) {
+		fetches.Add(1)
+		switch state.Load() {
+		case 0:
+			_ = json.NewEncoder(w).Encode(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{other}})
+		case 1:
+			w.WriteHeader(http.StatusInternalServerError)
+		default:
+			_ = json.NewEncoder(w).Encode(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{pub}})
+		}
+	}))
+	defer srv.Close()
+
+	dx, err := NewDexWithContext(context.Background(), srv.URL, MinKeyRefreshInterval(50*time.Millisecond))
+	require.NoError(t, err)
+	defer func() { _ = dx.Close() }()
+
+	rq := httptest.NewRequest(http.MethodGet, srv.URL, nil)
+	rq.Header.Add("Authorization", "Bearer "+signToken(t, priv, srv.URL))
+
+	state.Store(1)
+	_, err = dx.User(rq)
+	require.Error(t, err)
+	require.False(t, dx.refresher.isUnknown(pub.KeyID))
+
+	state.Store(2)
+	require.Eventually(t, func() bool {
+		_, err := dx.User(rq)
+		return err == nil
+	}, 5*time.Second, 20*time.Millisecond)
+}
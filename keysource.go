@@ -0,0 +1,199 @@
+package security
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// KeyEncoding is the encoding of a key which is read by a HMACKeySource.
+type KeyEncoding int
+
+// The supported key encodings. Hex and base64 encoded keys may be surrounded
+// by whitespace, e.g. a trailing newline in a file.
+const (
+	KeyEncodingRaw KeyEncoding = iota
+	KeyEncodingHex
+	KeyEncodingBase64
+)
+
+func (e KeyEncoding) decode(data []byte) ([]byte, error) {
+	switch e {
+	case KeyEncodingRaw:
+		return data, nil
+	case KeyEncodingHex:
+		return hex.DecodeString(string(bytes.TrimSpace(data)))
+	case KeyEncodingBase64:
+		s := string(bytes.TrimSpace(data))
+		key, err := base64.StdEncoding.DecodeString(s)
+		if err != nil {
+			return base64.RawStdEncoding.DecodeString(s)
+		}
+		return key, nil
+	default:
+		return nil, fmt.Errorf("unknown key encoding %d", e)
+	}
+}
+
+// A HMACKeySource returns the current key of a HMACAuth.
+type HMACKeySource interface {
+	Key() ([]byte, error)
+}
+
+// KeySourceFunc is a func which implements the HMACKeySource.
+type KeySourceFunc func() ([]byte, error)
+
+// Key implements the HMACKeySource.
+func (f KeySourceFunc) Key() ([]byte, error) {
+	return f()
+}
+
+// FileKeySource returns a HMACKeySource which reads the key from the given file
+// every time it is called, so a mounted secret which is rotated is picked up.
+func FileKeySource(path string, enc KeyEncoding) HMACKeySource {
+	return KeySourceFunc(func() ([]byte, error) {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read hmac key: %w", err)
+		}
+		return decodeKey(data, enc, path)
+	})
+}
+
+// EnvKeySource returns a HMACKeySource which reads the key from the given
+// environment variable.
+func EnvKeySource(name string, enc KeyEncoding) HMACKeySource {
+	return KeySourceFunc(func() ([]byte, error) {
+		data, ok := os.LookupEnv(name)
+		if !ok {
+			return nil, fmt.Errorf("environment variable %q for hmac key not set", name)
+		}
+		return decodeKey([]byte(data), enc, "$"+name)
+	})
+}
+
+func decodeKey(data []byte, enc KeyEncoding, origin string) ([]byte, error) {
+	key, err := enc.decode(data)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decode hmac key from %s: %w", origin, err)
+	}
+	if len(key) == 0 {
+		return nil, fmt.Errorf("hmac key from %s is empty", origin)
+	}
+	return key, nil
+}
+
+// HMACKeyReloader holds the key of a HMACAuth which is loaded from a
+// HMACKeySource. The key is replaced atomically, so requests which are verified
+// while the key changes either use the old or the new key. The previous key is
+// still accepted within a grace period, so requests which were signed by a
+// client before it got the new key are not rejected.
+type HMACKeyReloader struct {
+	src   HMACKeySource
+	log   *slog.Logger
+	grace time.Duration
+	now   func() time.Time
+
+	// lock serializes the reloads, readers only use keys
+	lock sync.Mutex
+	keys atomic.Pointer[reloadedKeys]
+}
+
+type reloadedKeys struct {
+	current  []byte
+	previous []byte
+	rotated  time.Time
+}
+
+// HMACKeyReloaderOption is a option type for HMACKeyReloader
+type HMACKeyReloaderOption func(*HMACKeyReloader)
+
+// WithGracePeriod sets the duration the previous key is still accepted after a
+// new key was loaded, the default is one minute.
+func WithGracePeriod(d time.Duration) HMACKeyReloaderOption {
+	return func(r *HMACKeyReloader) {
+		r.grace = d
+	}
+}
+
+// NewHMACKeyReloader returns a new HMACKeyReloader which has already loaded the
+// key from the given source. If log is nil, the default slog logger is used.
+func NewHMACKeyReloader(log *slog.Logger, src HMACKeySource, opts ...HMACKeyReloaderOption) (*HMACKeyReloader, error) {
+	if log == nil {
+		log = slog.Default()
+	}
+	r := &HMACKeyReloader{
+		src:   src,
+		log:   log,
+		grace: time.Minute,
+		now:   time.Now,
+	}
+	for _, o := range opts {
+		o(r)
+	}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload loads the key from the source. If the key changed, the current key
+// becomes the previous one. On errors the current key is kept.
+func (r *HMACKeyReloader) Reload() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	key, err := r.src.Key()
+	if err != nil {
+		return err
+	}
+	old := r.keys.Load()
+	if old != nil && bytes.Equal(old.current, key) {
+		return nil
+	}
+	next := &reloadedKeys{current: key}
+	if old != nil {
+		next.previous = old.current
+		next.rotated = r.now()
+	}
+	r.keys.Store(next)
+	if old != nil {
+		r.log.Info("hmac key reloaded")
+	}
+	return nil
+}
+
+// Watch reloads the key in the given interval until the context is done. Errors
+// are logged and the current key is kept.
+func (r *HMACKeyReloader) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := r.Reload(); err != nil {
+				r.log.Error("error reloading hmac key", "error", err)
+			}
+		}
+	}
+}
+
+// ring returns the current key and the previous key, which is only valid until
+// the end of the grace period.
+func (r *HMACKeyReloader) ring(id string) (HMACKey, []HMACKey) {
+	keys := r.keys.Load()
+	current := HMACKey{ID: id, Key: keys.current}
+	if keys.previous == nil || r.grace <= 0 {
+		return current, nil
+	}
+	return current, []HMACKey{{ID: id, Key: keys.previous, NotAfter: keys.rotated.Add(r.grace)}}
+}
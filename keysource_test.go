@@ -0,0 +1,150 @@
+package security
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileKeySource(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		enc     KeyEncoding
+		want    []byte
+		wantErr string
+	}{
+		{
+			name:    "raw",
+			content: "secret\n",
+			enc:     KeyEncodingRaw,
+			want:    []byte("secret\n"),
+		},
+		{
+			name:    "hex",
+			content: "010203\n",
+			enc:     KeyEncodingHex,
+			want:    []byte{1, 2, 3},
+		},
+		{
+			name:    "base64",
+			content: " AQID\n",
+			enc:     KeyEncodingBase64,
+			want:    []byte{1, 2, 3},
+		},
+		{
+			name:    "base64 without padding",
+			content: "AQIDBA",
+			enc:     KeyEncodingBase64,
+			want:    []byte{1, 2, 3, 4},
+		},
+		{
+			name:    "illegal hex",
+			content: "xyz",
+			enc:     KeyEncodingHex,
+			wantErr: "cannot decode hmac key",
+		},
+		{
+			name:    "empty",
+			content: "\n",
+			enc:     KeyEncodingHex,
+			wantErr: "is empty",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "key")
+			require.NoError(t, os.WriteFile(path, []byte(tt.content), 0600))
+
+			got, err := FileKeySource(path, tt.enc).Key()
+			if tt.wantErr != "" {
+				require.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.want, got)
+		})
+	}
+
+	_, err := FileKeySource(filepath.Join(t.TempDir(), "missing"), KeyEncodingRaw).Key()
+	require.ErrorContains(t, err, "cannot read hmac key")
+}
+
+func TestEnvKeySource(t *testing.T) {
+	t.Setenv("HMAC_TEST_KEY", "0a0b")
+	got, err := EnvKeySource("HMAC_TEST_KEY", KeyEncodingHex).Key()
+	require.NoError(t, err)
+	require.Equal(t, []byte{10, 11}, got)
+
+	_, err = EnvKeySource("HMAC_TEST_KEY_MISSING", KeyEncodingHex).Key()
+	require.EqualError(t, err, "environment variable \"HMAC_TEST_KEY_MISSING\" for hmac key not set")
+}
+
+func TestHMACKeyReloader(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "key")
+	require.NoError(t, os.WriteFile(path, []byte("010203"), 0600))
+
+	r, err := NewHMACKeyReloader(nil, FileKeySource(path, KeyEncodingHex))
+	require.NoError(t, err)
+	now := time.Now()
+	r.now = func() time.Time { return now }
+
+	server := NewHMACAuth("mytype", nil, WithKeyReloader(r))
+	oldClient := NewHMACAuth("mytype", []byte{1, 2, 3})
+	newClient := NewHMACAuth("mytype", []byte{4, 5, 6})
+
+	user := func(client HMACAuth) error {
+		rq := httptest.NewRequest(http.MethodGet, "/myurl", nil)
+		client.AddAuth(rq, time.Now(), nil)
+		_, err := server.User(rq)
+		return err
+	}
+	require.NoError(t, user(oldClient))
+	require.Error(t, user(newClient))
+
+	// a broken key is ignored
+	require.NoError(t, os.WriteFile(path, []byte("xyz"), 0600))
+	require.Error(t, r.Reload())
+	require.NoError(t, user(oldClient))
+
+	require.NoError(t, os.WriteFile(path, []byte("040506"), 0600))
+	require.NoError(t, r.Reload())
+	require.NoError(t, user(newClient))
+	// the old key is accepted within the grace period
+	require.NoError(t, user(oldClient))
+
+	now = now.Add(-2 * time.Minute)
+	require.NoError(t, os.WriteFile(path, []byte("070809"), 0600))
+	require.NoError(t, r.Reload())
+	var wrong *WrongHMAC
+	require.ErrorAs(t, user(oldClient), &wrong)
+	// the previous key is expired as well
+	require.ErrorAs(t, user(newClient), &wrong)
+}
+
+func TestHMACKeyReloader_Watch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "key")
+	require.NoError(t, os.WriteFile(path, []byte("010203"), 0600))
+
+	r, err := NewHMACKeyReloader(nil, FileKeySource(path, KeyEncodingHex), WithGracePeriod(0))
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go r.Watch(ctx, 10*time.Millisecond)
+
+	require.NoError(t, os.WriteFile(path, []byte("040506"), 0600))
+	require.Eventually(t, func() bool {
+		current, previous := r.ring("")
+		return string(current.Key) == string([]byte{4, 5, 6}) && previous == nil
+	}, time.Second, 10*time.Millisecond)
+
+	_, err = NewHMACKeyReloader(nil, FileKeySource(filepath.Join(t.TempDir(), "missing"), KeyEncodingHex))
+	require.Error(t, err)
+}
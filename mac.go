@@ -3,12 +3,13 @@ package security
 import (
 	"crypto/hmac"
 	"crypto/rand"
-	"crypto/sha256"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	"math/big"
 	"net/http"
+	"net/url"
+	"slices"
 	"strings"
 	"time"
 
@@ -37,17 +38,103 @@ func newWrongHMAC(got, want string) *WrongHMAC {
 	return &WrongHMAC{Got: got, Want: want}
 }
 
+// ClockSkewError is returned if the timestamp of a request is too old or too
+// far in the future. It contains the time of the server and of the client, so
+// clients with a broken time synchronization can be found in the logs.
+type ClockSkewError struct {
+	ServerTime time.Time
+	ClientTime time.Time
+	// MaxPast and MaxFuture are the accepted tolerances of the server.
+	MaxPast   time.Duration
+	MaxFuture time.Duration
+}
+
+// Skew returns the difference between the client and the server time. It is
+// positive if the clock of the client is ahead.
+func (c *ClockSkewError) Skew() time.Duration {
+	return c.ClientTime.Sub(c.ServerTime)
+}
+
+func (c *ClockSkewError) Error() string {
+	client := c.ClientTime.UTC().Format(time.RFC3339)
+	server := c.ServerTime.UTC().Format(time.RFC3339)
+	if c.Skew() > 0 {
+		return fmt.Sprintf("the timestamp in your header is too far in the future: %q, server time is %q, please check if you have time synchronization activated", client, server)
+	}
+	return fmt.Sprintf("the timestamp in your header is too old: %q, server time is %q, please check if you have time synchronization activated", client, server)
+}
+
 var (
-	errIllegalAuthFound = errors.New("illegal auth found")
-	errUnknownAuthFound = errors.New("unknown authtype found")
+	errIllegalAuthFound = &AuthError{Kind: AuthErrorMalformed, Err: errors.New("illegal auth found")}
+	errUnknownAuthFound = &AuthError{Kind: AuthErrorUnknownScheme, Err: errors.New("unknown authtype found")}
 )
 
 // A HMACAuth is an authenticator which uses a hmac calculation.
 type HMACAuth struct {
 	key      []byte
+	keyID    string
+	keys     []HMACKey
 	Lifetime time.Duration
-	Type     string
-	AuthUser User
+	// FutureSkew is the tolerance for timestamps which are in the future.
+	FutureSkew time.Duration
+	Type       string
+	AuthUser   User
+	// BodyDigest binds the request body to the hmac. The client sends the
+	// digest of the body in the "Content-Digest" header and the server
+	// verifies it against the received body.
+	BodyDigest bool
+	// Version is the version of the scheme a client uses to sign requests.
+	Version int
+	// MinVersion is the lowest version of the scheme a server accepts.
+	MinVersion int
+	// SignedHeaders are the headers which are signed in addition to the host
+	// if the request is signed with version 2 of the scheme.
+	SignedHeaders []string
+	// Algorithm is the algorithm a client uses to sign requests.
+	Algorithm string
+	// AllowedAlgorithms are the algorithms a server accepts. If empty, only
+	// the Algorithm is accepted.
+	AllowedAlgorithms []string
+	// SignedResponses enables the signing of responses by the server and
+	// their verification by the client.
+	SignedResponses bool
+	// ResponseHeaders are the headers which are signed in addition to the
+	// digest of the body if SignedResponses is enabled.
+	ResponseHeaders []string
+	// MaxBodySize limits the body which is read if BodyDigest is enabled, if
+	// it is not set, DefaultMaxBodySize is used.
+	MaxBodySize int64
+
+	nonces   NonceStore
+	reloader *HMACKeyReloader
+	clientID string
+	clients  ClientResolver
+	// err is the error of the configuration, see Err
+	err error
+}
+
+// A HMACKey is an additional key of a HMACAuth. Keys are identified by their
+// ID which is transported in the "Authorization" header, so a server can accept
+// the current and the previous keys while the clients are rotated.
+type HMACKey struct {
+	ID  string
+	Key []byte
+	// NotBefore and NotAfter limit the validity of the key, zero values are
+	// not checked.
+	NotBefore time.Time
+	NotAfter  time.Time
+	// User is connected to this key, if nil the AuthUser of the HMACAuth is used.
+	User *User
+}
+
+func (k *HMACKey) validAt(t time.Time) bool {
+	if !k.NotBefore.IsZero() && t.Before(k.NotBefore) {
+		return false
+	}
+	if !k.NotAfter.IsZero() && t.After(k.NotAfter) {
+		return false
+	}
+	return true
 }
 
 // HMACAuthOption is a option type for HMACAuth
@@ -56,21 +143,46 @@ type HMACAuthOption func(*HMACAuth)
 // NewHMACAuth returns a new HMACAuth initialized with the given key. A service
 // implementation and a client must share the same key and authtype. The authtype
 // will be transported as a scheme in the "Authentication" header. The key
-// has to be private and will never be transmitted over the wire.
+// has to be private and will never be transmitted over the wire. If the
+// options are invalid, e.g. an algorithm is not supported, the returned
+// HMACAuth rejects all requests and signs nothing, see Err.
 func NewHMACAuth(authtype string, key []byte, opts ...HMACAuthOption) HMACAuth {
 	res := HMACAuth{
-		key:      key,
-		Lifetime: 15 * time.Second,
-		Type:     authtype,
-		AuthUser: guest,
+		key:        key,
+		Lifetime:   15 * time.Second,
+		FutureSkew: 15 * time.Second,
+		Type:       authtype,
+		AuthUser:   guest,
+		Version:    HMACVersion1,
+		MinVersion: HMACVersion1,
+		Algorithm:  HMACSHA256,
 	}
 	for _, o := range opts {
 		o(&res)
 	}
+	res.err = res.checkAlgorithms()
 
 	return res
 }
 
+// Err returns the error of the configuration which was given to NewHMACAuth,
+// e.g. an unsupported algorithm. A HMACAuth with an error rejects all requests
+// with an AuthError of the kind AuthErrorUnavailable and signs nothing.
+func (hma *HMACAuth) Err() error {
+	return hma.err
+}
+
+// checkAlgorithms returns an error if the algorithm or one of the allowed
+// algorithms is not supported.
+func (hma *HMACAuth) checkAlgorithms() error {
+	for _, alg := range append([]string{hma.Algorithm}, hma.AllowedAlgorithms...) {
+		if _, err := hmacHash(alg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // WithUser sets the user which is connected to this HMAC auth.
 func WithUser(u User) HMACAuthOption {
 	return func(h *HMACAuth) {
@@ -78,6 +190,128 @@ func WithUser(u User) HMACAuthOption {
 	}
 }
 
+// WithKeyID sets the id of the key which was given to NewHMACAuth. A client
+// announces this id in the "Authorization" header, so the server knows which of
+// its keys to use. The id must not contain spaces, commas or equal signs.
+func WithKeyID(id string) HMACAuthOption {
+	return func(h *HMACAuth) {
+		h.keyID = id
+	}
+}
+
+// WithClientID sets the id of a client which signs its requests with a key
+// which was derived from the master key of the server with DeriveHMACKey. The id
+// is transported in the "Authorization" header and must not contain spaces,
+// commas or equal signs.
+func WithClientID(id string) HMACAuthOption {
+	return func(h *HMACAuth) {
+		h.clientID = id
+	}
+}
+
+// WithClientResolver lets a server derive the keys of its clients from its own
+// keys, which are the master keys then. Only requests of clients which send
+// their id are accepted, the user of a request is returned by the resolver.
+func WithClientResolver(r ClientResolver) HMACAuthOption {
+	return func(h *HMACAuth) {
+		h.clients = r
+	}
+}
+
+// WithKeys adds additional keys to the key ring. A server accepts a request
+// which is signed with any of its keys which is valid now, a client signs with
+// the valid key with the latest NotBefore. So the keys can be rotated by adding
+// the new key with a NotBefore in the future and the old key with a NotAfter to
+// the servers and the clients.
+func WithKeys(keys ...HMACKey) HMACAuthOption {
+	return func(h *HMACAuth) {
+		h.keys = append(h.keys, keys...)
+	}
+}
+
+// WithBodyDigest enables the signing of the request body. Client and server
+// must both enable this option, otherwise the hmac will not match.
+func WithBodyDigest() HMACAuthOption {
+	return func(h *HMACAuth) {
+		h.BodyDigest = true
+	}
+}
+
+// WithCanonicalRequest lets the client sign the canonical request (version 2 of
+// the scheme), i.e. the path, the sorted query, the host and the given headers.
+// A server with this option requires the given headers to be signed by
+// clients which use version 2.
+// AddAuthToClientRequest, AuthHeaders and AuthHeadersWithBody cannot sign the
+// canonical request, so use the HMACRoundTripper, AddAuth or RequestAuthHeaders.
+func WithCanonicalRequest(headers ...string) HMACAuthOption {
+	return func(h *HMACAuth) {
+		h.Version = HMACVersion2
+		h.SignedHeaders = headers
+	}
+}
+
+// WithMinVersion sets the lowest version of the scheme which is accepted by a
+// server. Use this to reject old clients after all clients were updated.
+func WithMinVersion(v int) HMACAuthOption {
+	return func(h *HMACAuth) {
+		h.MinVersion = v
+	}
+}
+
+// WithMaxBodySize limits the body which a server reads if BodyDigest is
+// enabled, the default is DefaultMaxBodySize.
+func WithMaxBodySize(n int64) HMACAuthOption {
+	return func(hma *HMACAuth) {
+		hma.MaxBodySize = n
+	}
+}
+
+// WithAlgorithm sets the algorithm which is used to sign requests, the default
+// is HMACSHA256. Client and server must use the same algorithm, or the server
+// must allow the algorithm of the client with WithAllowedAlgorithms.
+func WithAlgorithm(alg string) HMACAuthOption {
+	return func(h *HMACAuth) {
+		h.Algorithm = alg
+	}
+}
+
+// WithAllowedAlgorithms sets the algorithms which are accepted by a server. Use
+// this to migrate the clients to another algorithm.
+func WithAllowedAlgorithms(algs ...string) HMACAuthOption {
+	return func(h *HMACAuth) {
+		h.AllowedAlgorithms = algs
+	}
+}
+
+// WithKeyReloader lets the HMACAuth use the key of the given reloader instead of
+// the key which was given to NewHMACAuth. Start the Watch of the reloader to pick
+// up changed keys.
+func WithKeyReloader(r *HMACKeyReloader) HMACAuthOption {
+	return func(h *HMACAuth) {
+		h.reloader = r
+	}
+}
+
+// WithSignedResponses lets a server sign its responses with SignResponses and a
+// client (i.e. the HMACRoundTripper) reject responses which are unsigned or
+// tampered with. The status, the digest of the body, the salt of the request and
+// the given headers are signed.
+func WithSignedResponses(headers ...string) HMACAuthOption {
+	return func(h *HMACAuth) {
+		h.SignedResponses = true
+		h.ResponseHeaders = headers
+	}
+}
+
+// WithNonceStore sets the store which remembers the salts of accepted requests.
+// Every salt is then only accepted once within the lifetime, so a captured
+// request cannot be replayed.
+func WithNonceStore(ns NonceStore) HMACAuthOption {
+	return func(h *HMACAuth) {
+		h.nonces = ns
+	}
+}
+
 // WithLifetime sets the lifetime which is connected to this HMAC auth. If the
 // lifetime is zero, there will be no datetime checking. Do not do this in
 // productive code (only useful in tests).
@@ -87,55 +321,196 @@ func WithLifetime(max time.Duration) HMACAuthOption {
 	}
 }
 
-func (hma *HMACAuth) createMac(vals ...[]byte) string {
-	h := hmac.New(sha256.New, hma.key)
+// WithClockSkew sets the tolerances for the timestamp of a request. A request
+// is accepted if its timestamp is at most past before and at most future after
+// the time of the server. The past tolerance is the lifetime of the request, so
+// if it is zero there will be no datetime checking at all.
+func WithClockSkew(past, future time.Duration) HMACAuthOption {
+	return func(h *HMACAuth) {
+		h.Lifetime = past
+		h.FutureSkew = future
+	}
+}
+
+func (hma *HMACAuth) createMacWithKey(key []byte, alg string, vals ...[]byte) (string, error) {
+	hf, err := hmacHash(alg)
+	if err != nil {
+		return "", err
+	}
+	h := hmac.New(hf, key)
 	for _, v := range vals {
 		// FIXME add errcheck
 		//nolint:errcheck
 		h.Write(v)
 	}
 	sha := hex.EncodeToString(h.Sum(nil))
-	return sha
+	return sha, nil
 }
 
 // create returns a a formatted timestamp and the generated HMAC.
-func (hma *HMACAuth) create(t time.Time, vals ...[]byte) (string, string) {
+func (hma *HMACAuth) create(t time.Time, vals ...[]byte) (string, string, error) {
+	return hma.createWithKey(hma.key, hma.Algorithm, t, vals...)
+}
+
+func (hma *HMACAuth) createWithKey(key []byte, alg string, t time.Time, vals ...[]byte) (string, string, error) {
 	ts := t.UTC().Format(time.RFC3339)
 	vals = append([][]byte{[]byte(ts)}, vals...)
-	return hma.createMac(vals...), ts
+	mac, err := hma.createMacWithKey(key, alg, vals...)
+	return mac, ts, err
+}
+
+// keyRing returns the key which was given to NewHMACAuth or the current key of
+// the reloader followed by the additional keys.
+func (hma *HMACAuth) keyRing() []HMACKey {
+	if hma.reloader != nil {
+		current, previous := hma.reloader.ring(hma.keyID)
+		return slices.Concat([]HMACKey{current}, previous, hma.keys)
+	}
+	return append([]HMACKey{{ID: hma.keyID, Key: hma.key}}, hma.keys...)
+}
+
+// signingKey returns the key which is valid at the given time and has the
+// latest NotBefore. The key which was given to NewHMACAuth wins a tie.
+func (hma *HMACAuth) signingKey(t time.Time) HMACKey {
+	ring := hma.keyRing()
+	res := ring[0]
+	for _, k := range ring[1:] {
+		if k.validAt(t) && k.NotBefore.After(res.NotBefore) {
+			res = k
+		}
+	}
+	return res
+}
+
+// verificationKeys returns all keys with the given id which are valid now.
+func (hma *HMACAuth) verificationKeys(id string) ([]HMACKey, error) {
+	var (
+		now   = time.Now()
+		found bool
+		res   []HMACKey
+	)
+	for _, k := range hma.keyRing() {
+		if k.ID != id {
+			continue
+		}
+		found = true
+		if k.validAt(now) {
+			res = append(res, k)
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("unknown key id %q", id)
+	}
+	if len(res) == 0 {
+		return nil, fmt.Errorf("the key with id %q is not valid anymore", id)
+	}
+	return res, nil
 }
 
 // AddAuth adds the needed headers to the given request so the given values in the vals-array
 // are correctly signed. This function can be used by a client to enhance the request before
-// submitting it.
+// submitting it. The body is only signed if BodyDigest is enabled and must be the
+// content which is sent with the request. No headers are added if the HMACAuth
+// has an error, see Err.
 func (hma *HMACAuth) AddAuth(rq *http.Request, t time.Time, body []byte) {
-	headers := hma.AuthHeaders(rq.Method, t)
+	headers, _ := hma.authHeaders(clientRequestData(rq, body), t)
 	for k, v := range headers {
 		rq.Header.Add(k, v)
 	}
 }
 
-// AddAuthToClientRequest to support openapi too
-func (hma *HMACAuth) AddAuthToClientRequest(rq runtime.ClientRequest, t time.Time) {
-	headers := hma.AuthHeaders(rq.GetMethod(), t)
+// ErrCanonicalRequestUnsupported is returned if a HMACAuth which signs the
+// canonical request (version 2 of the scheme) is used with a function which
+// does not know the path, the query and the host of the request.
+var ErrCanonicalRequestUnsupported = errors.New("the canonical request cannot be signed without its path and host, use RequestAuthHeaders or the HMACRoundTripper")
+
+// AddAuthToClientRequest to support openapi too. If BodyDigest is enabled the
+// body must already be set when this function is called. The openapi request
+// neither knows the base path nor the host, so the canonical request cannot be
+// signed. It returns ErrCanonicalRequestUnsupported and adds no headers if
+// WithCanonicalRequest is set, use the HMACRoundTripper as the transport of
+// the openapi runtime instead.
+func (hma *HMACAuth) AddAuthToClientRequest(rq runtime.ClientRequest, t time.Time) error {
+	rqd := RequestData{
+		Method: rq.GetMethod(),
+		Body:   rq.GetBody(),
+	}
+	headers, err := hma.authHeadersWithoutRequest(rqd, t)
+	if err != nil {
+		return err
+	}
 	for k, v := range headers {
 		// FIXME add errcheck
 		//nolint:errcheck
 		rq.SetHeaderParam(k, v)
 	}
+	return nil
 }
 
-// AuthHeaders creates the necessary headers
+// AuthHeaders creates the necessary headers. If BodyDigest is enabled, use
+// AuthHeadersWithBody instead. The canonical request cannot be signed with
+// this function, use RequestAuthHeaders for that. The headers are empty if
+// WithCanonicalRequest is set or if the HMACAuth has an error, see Err.
 func (hma *HMACAuth) AuthHeaders(method string, t time.Time) map[string]string {
-	salt := randByteString(24)
-	mac, ts := hma.create(t, []byte(method), salt)
+	headers, _ := hma.authHeadersWithoutRequest(RequestData{Method: method}, t)
+	return headers
+}
 
+// AuthHeadersWithBody creates the necessary headers for a request with the given body.
+// Like AuthHeaders it cannot sign the canonical request.
+func (hma *HMACAuth) AuthHeadersWithBody(method string, t time.Time, body []byte) map[string]string {
+	headers, _ := hma.authHeadersWithoutRequest(RequestData{Method: method, Body: body}, t)
+	return headers
+}
+
+// RequestAuthHeaders creates the necessary headers for the given request. If
+// WithCanonicalRequest is set, the Path, the Query, the Host and the signed
+// Header of the request must be set, they are the escaped path, the query, the
+// host and the headers which are sent. The Body is only signed if BodyDigest is
+// enabled.
+func (hma *HMACAuth) RequestAuthHeaders(rqd RequestData, t time.Time) (map[string]string, error) {
+	if hma.Version >= HMACVersion2 && (rqd.Path == "" || rqd.Host == "") {
+		return map[string]string{}, ErrCanonicalRequestUnsupported
+	}
+	return hma.authHeaders(rqd, t)
+}
+
+// authHeadersWithoutRequest creates the headers for a request of which only
+// the method and the body are known.
+func (hma *HMACAuth) authHeadersWithoutRequest(rqd RequestData, t time.Time) (map[string]string, error) {
+	if hma.Version >= HMACVersion2 {
+		return map[string]string{}, ErrCanonicalRequestUnsupported
+	}
+	return hma.authHeaders(rqd, t)
+}
+
+func (hma *HMACAuth) authHeaders(rqd RequestData, t time.Time) (map[string]string, error) {
+	if hma.err != nil {
+		return map[string]string{}, hma.err
+	}
 	headers := make(map[string]string)
+
+	rqd.SaltHeader = string(randByteString(24))
+	headers[SaltHeaderKey] = rqd.SaltHeader
+	if hma.BodyDigest {
+		rqd.DigestHeader = contentDigest(rqd.Body)
+		headers[DigestHeaderKey] = rqd.DigestHeader
+	}
+
+	key := hma.signingKey(t)
+	params := hmacParams{version: max(hma.Version, HMACVersion1), alg: hma.Algorithm, keyID: key.ID, clientID: hma.clientID}
+	if params.version >= HMACVersion2 {
+		params.headers = signedHeaders(hma.SignedHeaders)
+	}
+	mac, ts, err := hma.createWithKey(key.Key, params.algorithm(), t, hma.getData(rqd, params)...)
+	if err != nil {
+		return map[string]string{}, err
+	}
+	params.mac = mac
 	headers[TsHeaderKey] = ts
-	headers[SaltHeaderKey] = string(salt)
-	headers[AuthzHeaderKey] = hma.Type + " " + mac
+	headers[AuthzHeaderKey] = params.format(hma.Type)
 
-	return headers
+	return headers, nil
 }
 
 // RequestData wraps the http request data
@@ -144,6 +519,29 @@ type RequestData struct {
 	AuthzHeader     string
 	TimestampHeader string
 	SaltHeader      string
+	// DigestHeader and Body are only used if BodyDigest is enabled.
+	DigestHeader string
+	Body         []byte
+	// readBody reads the body after the hmac was verified, it is used instead
+	// of Body if it is set.
+	readBody func() ([]byte, error)
+	// Path, Query, Host and Header are only used for version 2 of the scheme.
+	Path   string
+	Query  url.Values
+	Host   string
+	Header http.Header
+}
+
+// clientRequestData returns the RequestData of a request which is sent by a client.
+func clientRequestData(rq *http.Request, body []byte) RequestData {
+	return RequestData{
+		Method: rq.Method,
+		Path:   rq.URL.EscapedPath(),
+		Query:  rq.URL.Query(),
+		Host:   requestHost(rq),
+		Header: rq.Header,
+		Body:   body,
+	}
 }
 
 // RequestDataGetter is a supplied func which returns the RequestData
@@ -153,6 +551,9 @@ type RequestDataGetter func() RequestData
 // are: Date-Header, Request-Method, Request-Content.
 // If the result does not match the HMAC in the header, this function returns an error. Otherwise
 // it returns the user which is connected to this hmac-auth.
+// If BodyDigest is enabled the body is read after the hmac was verified and
+// replaced by a buffered copy, so later handlers can still consume it. At most
+// MaxBodySize bytes are read.
 func (hma *HMACAuth) User(rq *http.Request) (*User, error) {
 
 	rqd := RequestData{
@@ -160,6 +561,17 @@ func (hma *HMACAuth) User(rq *http.Request) (*User, error) {
 		AuthzHeader:     rq.Header.Get(AuthzHeaderKey),
 		TimestampHeader: rq.Header.Get(TsHeaderKey),
 		SaltHeader:      rq.Header.Get(SaltHeaderKey),
+		DigestHeader:    rq.Header.Get(DigestHeaderKey),
+		Path:            rq.URL.EscapedPath(),
+		Query:           rq.URL.Query(),
+		Host:            rq.Host,
+		Header:          rq.Header,
+	}
+
+	if hma.BodyDigest {
+		rqd.readBody = func() ([]byte, error) {
+			return readBody(rq, hma.MaxBodySize)
+		}
 	}
 
 	return hma.UserFromRequestData(rqd)
@@ -169,7 +581,19 @@ func (hma *HMACAuth) User(rq *http.Request) (*User, error) {
 // are: Date-Header, Request-Method, Request-Content.
 // If the result does not match the HMAC in the header, this function returns an error. Otherwise
 // it returns the user which is connected to this hmac-auth.
+// All errors are of the type *AuthError.
 func (hma *HMACAuth) UserFromRequestData(requestData RequestData) (*User, error) {
+	u, err := hma.userFromRequestData(requestData)
+	if err != nil {
+		return nil, hma.authError(err)
+	}
+	return u, nil
+}
+
+func (hma *HMACAuth) userFromRequestData(requestData RequestData) (*User, error) {
+	if hma.err != nil {
+		return nil, &AuthError{Kind: AuthErrorUnavailable, Err: hma.err}
+	}
 
 	t := requestData.TimestampHeader
 	auth := requestData.AuthzHeader
@@ -183,32 +607,190 @@ func (hma *HMACAuth) UserFromRequestData(requestData RequestData) (*User, error)
 	if strings.TrimSpace(splitToken[0]) != hma.Type {
 		return nil, errUnknownAuthFound
 	}
-	hm := strings.TrimSpace(splitToken[1])
+	params, err := parseHMACParams(strings.TrimSpace(splitToken[1]))
+	if err != nil {
+		return nil, &AuthError{Kind: AuthErrorMalformed, Err: err}
+	}
+	if params.version < hma.MinVersion {
+		return nil, fmt.Errorf("hmac version %d is not accepted anymore, at least version %d is required", params.version, hma.MinVersion)
+	}
+	if !slices.Contains(hma.allowedAlgorithms(), params.algorithm()) {
+		return nil, fmt.Errorf("the hmac algorithm %q is not accepted", params.algorithm())
+	}
+	if params.version >= HMACVersion2 {
+		for _, h := range signedHeaders(hma.SignedHeaders) {
+			if !slices.Contains(params.headers, h) {
+				return nil, fmt.Errorf("the header %q must be signed", h)
+			}
+		}
+	}
+	hm := params.mac
 	ts, err := time.Parse(time.RFC3339, t)
 	if err != nil {
-		return nil, fmt.Errorf("unknown timestamp %q in %q header, use RFC3339: %w", t, TsHeaderKey, err)
+		return nil, &AuthError{Kind: AuthErrorMalformed, Err: fmt.Errorf("unknown timestamp %q in %q header, use RFC3339: %w", t, TsHeaderKey, err)}
 	}
 	if hma.Lifetime > 0 {
-		if time.Since(ts) > hma.Lifetime {
-			return nil, fmt.Errorf("the timestamp in your header is too old: %q, please check if you have time synchronization activated", t)
+		now := time.Now()
+		if now.Sub(ts) > hma.Lifetime || ts.Sub(now) > hma.FutureSkew {
+			return nil, &ClockSkewError{ServerTime: now, ClientTime: ts, MaxPast: hma.Lifetime, MaxFuture: hma.FutureSkew}
 		}
 	}
 
-	vals := hma.getData(requestData.Method, requestData.SaltHeader)
-	calc, _ := hma.create(ts, vals...)
-	if calc != hm {
+	if hma.BodyDigest && requestData.DigestHeader == "" {
+		return nil, fmt.Errorf("no %q header found, the body must be signed", DigestHeaderKey)
+	}
+
+	keys, err := hma.verificationKeys(params.keyID)
+	if err != nil {
+		return nil, err
+	}
+	keys, err = hma.clientKeys(keys, params.clientID)
+	if err != nil {
+		return nil, err
+	}
+	vals := hma.getData(requestData, *params)
+	var (
+		calc  string
+		match *HMACKey
+	)
+	for i := range keys {
+		c, _, err := hma.createWithKey(keys[i].Key, params.algorithm(), ts, vals...)
+		if err != nil {
+			return nil, err
+		}
+		if hmac.Equal([]byte(c), []byte(hm)) {
+			match = &keys[i]
+			break
+		}
+		if calc == "" {
+			calc = c
+		}
+	}
+	if match == nil {
 		return nil, newWrongHMAC(hm, calc)
 	}
+	// the digest is part of the hmac, so the body is only read if the hmac is
+	// valid
+	if hma.BodyDigest {
+		body := requestData.Body
+		if requestData.readBody != nil {
+			body, err = requestData.readBody()
+			if err != nil {
+				return nil, err
+			}
+		}
+		if err := verifyContentDigest(requestData.DigestHeader, body); err != nil {
+			return nil, err
+		}
+	}
+	if err := hma.checkNonce(requestData.SaltHeader, ts); err != nil {
+		return nil, err
+	}
+	if hma.clients != nil {
+		u, err := hma.clients(params.clientID)
+		if err != nil {
+			return nil, err
+		}
+		return u, nil
+	}
 	// lets return a copy of our user so the caller cannot change it
 	newuser := hma.AuthUser
+	if match.User != nil {
+		newuser = *match.User
+	}
+	// the request is authenticated, even if the user is the guest
+	newuser.anonymous = false
 	return &newuser, nil
 }
 
-func (hma *HMACAuth) getData(method, saltHeader string) [][]byte {
-	return [][]byte{
-		[]byte(method),
-		[]byte(saltHeader),
+// authError returns the error as a AuthError of this HMACAuth.
+func (hma *HMACAuth) authError(err error) error {
+	var skew *ClockSkewError
+	kind := AuthErrorInvalidCredentials
+	switch {
+	case errors.As(err, &skew):
+		kind = AuthErrorExpired
+	case errors.Is(err, ErrReplayedRequest):
+		kind = AuthErrorReplayed
+	}
+	return newAuthError("hmac:"+hma.Type, kind, err)
+}
+
+// clientKeys derives the keys of the given client from the master keys if the
+// server uses derived keys.
+func (hma *HMACAuth) clientKeys(keys []HMACKey, clientID string) ([]HMACKey, error) {
+	if hma.clients == nil {
+		if clientID != "" {
+			return nil, fmt.Errorf("client ids are not supported for hmac type %q", hma.Type)
+		}
+		return keys, nil
+	}
+	if clientID == "" {
+		return nil, fmt.Errorf("no client id found in %q header", AuthzHeaderKey)
+	}
+	res := make([]HMACKey, 0, len(keys))
+	for _, k := range keys {
+		derived, err := DeriveHMACKey(k.Key, hma.Type, clientID)
+		if err != nil {
+			return nil, err
+		}
+		k.Key = derived
+		res = append(res, k)
+	}
+	return res, nil
+}
+
+// allowedAlgorithms returns the algorithms a server accepts.
+func (hma *HMACAuth) allowedAlgorithms() []string {
+	if len(hma.AllowedAlgorithms) > 0 {
+		return hma.AllowedAlgorithms
+	}
+	if hma.Algorithm == "" {
+		return []string{HMACSHA256}
+	}
+	return []string{hma.Algorithm}
+}
+
+// checkNonce stores the salt of an accepted request in the nonce store and
+// returns an error if it was already stored.
+func (hma *HMACAuth) checkNonce(salt string, ts time.Time) error {
+	if hma.nonces == nil {
+		return nil
+	}
+	if salt == "" {
+		return fmt.Errorf("no %q header found", SaltHeaderKey)
+	}
+	var expires time.Time
+	if hma.Lifetime > 0 {
+		expires = ts.Add(hma.Lifetime)
+	}
+	fresh, err := hma.nonces.Add(hma.Type+"|"+salt, expires)
+	if err != nil {
+		return &AuthError{Kind: AuthErrorUnavailable, Err: fmt.Errorf("cannot check salt of the request: %w", err)}
+	}
+	if !fresh {
+		return ErrReplayedRequest
+	}
+	return nil
+}
+
+func (hma *HMACAuth) getData(rqd RequestData, params hmacParams) [][]byte {
+	var vals [][]byte
+	if params.version >= HMACVersion2 {
+		vals = [][]byte{[]byte(canonicalRequest(rqd, params.headers))}
+		if hma.BodyDigest {
+			vals = append(vals, []byte("\n"+rqd.DigestHeader))
+		}
+		return vals
+	}
+	vals = [][]byte{
+		[]byte(rqd.Method),
+		[]byte(rqd.SaltHeader),
+	}
+	if hma.BodyDigest {
+		vals = append(vals, []byte(rqd.DigestHeader))
 	}
+	return vals
 }
 
 // replaceable function to create a random byte string
@@ -6,13 +6,16 @@ import (
 	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/go-openapi/runtime"
 	"github.com/stretchr/testify/require"
 )
 
@@ -129,9 +132,8 @@ func TestHMACAuth_User(t *testing.T) {
 			auth: authtype + " 1234567",
 			ts:   tm.Format(time.RFC3339),
 			errcheck: func(t *testing.T, e error) {
-				//nolint:errorlint
-				_, ok := e.(*WrongHMAC)
-				if !ok {
+				var wrong *WrongHMAC
+				if !errors.As(e, &wrong) {
 					t.Fatalf("the error is not a wrong hmac")
 				}
 			},
@@ -170,6 +172,24 @@ func TestHMACAuth_User(t *testing.T) {
 				}
 			},
 		},
+		{
+			name:     "from the future",
+			auth:     "<calc>",
+			ts:       time.Now().Add(365 * 24 * time.Hour).Format(time.RFC3339),
+			lifetime: 10 * time.Second,
+			errcheck: func(t *testing.T, e error) {
+				var skew *ClockSkewError
+				if !errors.As(e, &skew) {
+					t.Fatalf("the error %q is unexpected", e)
+				}
+				if !strings.Contains(e.Error(), "too far in the future") {
+					t.Fatalf("the error %q is unexpected", e)
+				}
+				if skew.Skew() < 364*24*time.Hour {
+					t.Fatalf("the skew %s is unexpected", skew.Skew())
+				}
+			},
+		},
 	}
 
 	for _, st := range testdata {
@@ -201,10 +221,495 @@ func TestHMACAuth_User(t *testing.T) {
 	}
 }
 
+func TestHMACAuth_UserWithBodyDigest(t *testing.T) {
+	tm := time.Date(2019, time.January, 16, 14, 44, 45, 123, time.UTC)
+	u := User{Name: "Bicycle Repair Man"}
+	mybody := []byte("{\"name\":\"my-machine\"}")
+
+	testdata := []struct {
+		name    string
+		modify  func(rq *http.Request) *http.Request
+		wantErr string
+	}{
+		{
+			name: "correct usage",
+		},
+		{
+			name: "tampered body",
+			modify: func(rq *http.Request) *http.Request {
+				nrq := httptest.NewRequest(http.MethodPost, "/myurl", strings.NewReader("{\"name\":\"your-machine\"}"))
+				nrq.Header = rq.Header
+				return nrq
+			},
+			wantErr: "the \"sha-256\" digest in \"Content-Digest\" header does not match the content",
+		},
+		{
+			name: "tampered body and digest",
+			modify: func(rq *http.Request) *http.Request {
+				body := []byte("{\"name\":\"your-machine\"}")
+				nrq := httptest.NewRequest(http.MethodPost, "/myurl", bytes.NewReader(body))
+				nrq.Header = rq.Header
+				nrq.Header.Set(DigestHeaderKey, contentDigest(body))
+				return nrq
+			},
+			wantErr: "Wrong HMAC found",
+		},
+		{
+			name: "missing digest",
+			modify: func(rq *http.Request) *http.Request {
+				rq.Header.Del(DigestHeaderKey)
+				return rq
+			},
+			wantErr: "no \"Content-Digest\" header found, the body must be signed",
+		},
+	}
+
+	for _, st := range testdata {
+		t.Run(st.name, func(t *testing.T) {
+			hm := NewHMACAuth("mytype", []byte{1, 2, 3}, WithUser(u), WithLifetime(0), WithBodyDigest())
+			rq := httptest.NewRequest(http.MethodPost, "/myurl", bytes.NewReader(mybody))
+			hm.AddAuth(rq, tm, mybody)
+			require.Equal(t, contentDigest(mybody), rq.Header.Get(DigestHeaderKey))
+			if st.modify != nil {
+				rq = st.modify(rq)
+			}
+
+			usr, err := hm.User(rq)
+			if st.wantErr != "" {
+				require.EqualError(t, err, st.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, u.Name, usr.Name)
+
+			// the body must still be readable for the handler
+			body, err := io.ReadAll(rq.Body)
+			require.NoError(t, err)
+			require.Equal(t, mybody, body)
+		})
+	}
+}
+
+func TestHMACAuth_UserWithCanonicalRequest(t *testing.T) {
+	tm := time.Date(2019, time.January, 16, 14, 44, 45, 123, time.UTC)
+	u := User{Name: "Bicycle Repair Man"}
+
+	testdata := []struct {
+		name       string
+		client     []HMACAuthOption
+		server     []HMACAuthOption
+		modify     func(rq *http.Request)
+		wantHeader string
+		wantErr    string
+	}{
+		{
+			name:       "correct usage",
+			client:     []HMACAuthOption{WithCanonicalRequest()},
+			server:     []HMACAuthOption{WithCanonicalRequest()},
+			wantHeader: "mytype v=2,h=host,mac=",
+		},
+		{
+			name:       "correct usage with additional header",
+			client:     []HMACAuthOption{WithCanonicalRequest("Content-Type")},
+			server:     []HMACAuthOption{WithCanonicalRequest("content-type")},
+			wantHeader: "mytype v=2,h=host;content-type,mac=",
+		},
+		{
+			name:       "query params in different order",
+			client:     []HMACAuthOption{WithCanonicalRequest()},
+			server:     []HMACAuthOption{WithCanonicalRequest()},
+			modify:     func(rq *http.Request) { rq.URL.RawQuery = "id=2&id=1" },
+			wantHeader: "mytype v=2,h=host,mac=",
+		},
+		{
+			name:    "tampered path",
+			client:  []HMACAuthOption{WithCanonicalRequest()},
+			server:  []HMACAuthOption{WithCanonicalRequest()},
+			modify:  func(rq *http.Request) { rq.URL.Path = "/v1/secret/anything" },
+			wantErr: "Wrong HMAC found",
+		},
+		{
+			name:    "tampered query",
+			client:  []HMACAuthOption{WithCanonicalRequest()},
+			server:  []HMACAuthOption{WithCanonicalRequest()},
+			modify:  func(rq *http.Request) { rq.URL.RawQuery = "id=1&id=3" },
+			wantErr: "Wrong HMAC found",
+		},
+		{
+			name:    "tampered host",
+			client:  []HMACAuthOption{WithCanonicalRequest()},
+			server:  []HMACAuthOption{WithCanonicalRequest()},
+			modify:  func(rq *http.Request) { rq.Host = "other.example.com" },
+			wantErr: "Wrong HMAC found",
+		},
+		{
+			name:    "tampered signed header",
+			client:  []HMACAuthOption{WithCanonicalRequest("Content-Type")},
+			server:  []HMACAuthOption{WithCanonicalRequest("Content-Type")},
+			modify:  func(rq *http.Request) { rq.Header.Set("Content-Type", "text/plain") },
+			wantErr: "Wrong HMAC found",
+		},
+		{
+			name:    "required header not signed",
+			client:  []HMACAuthOption{WithCanonicalRequest()},
+			server:  []HMACAuthOption{WithCanonicalRequest("Content-Type")},
+			wantErr: "the header \"content-type\" must be signed",
+		},
+		{
+			name:       "old client and new server",
+			server:     []HMACAuthOption{WithCanonicalRequest()},
+			wantHeader: "mytype ",
+		},
+		{
+			name:       "new client and old server",
+			client:     []HMACAuthOption{WithCanonicalRequest()},
+			wantHeader: "mytype v=2,h=host,mac=",
+		},
+		{
+			name:    "old client rejected",
+			server:  []HMACAuthOption{WithCanonicalRequest(), WithMinVersion(HMACVersion2)},
+			wantErr: "hmac version 1 is not accepted anymore, at least version 2 is required",
+		},
+	}
+
+	for _, st := range testdata {
+		t.Run(st.name, func(t *testing.T) {
+			client := NewHMACAuth("mytype", []byte{1, 2, 3}, st.client...)
+			server := NewHMACAuth("mytype", []byte{1, 2, 3}, append([]HMACAuthOption{WithUser(u), WithLifetime(0)}, st.server...)...)
+
+			rq := httptest.NewRequest(http.MethodGet, "/v1/machine?id=1&id=2", nil)
+			rq.Header.Set("Content-Type", "application/json")
+			client.AddAuth(rq, tm, nil)
+			require.True(t, strings.HasPrefix(rq.Header.Get(AuthzHeaderKey), st.wantHeader))
+			if st.modify != nil {
+				st.modify(rq)
+			}
+
+			usr, err := server.User(rq)
+			if st.wantErr != "" {
+				require.EqualError(t, err, st.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, u.Name, usr.Name)
+		})
+	}
+}
+
+// clientRequest is the part of an openapi client request which is used by
+// AddAuthToClientRequest.
+type clientRequest struct {
+	runtime.ClientRequest
+	method string
+	path   string
+	header http.Header
+}
+
+func (c *clientRequest) GetMethod() string            { return c.method }
+func (c *clientRequest) GetPath() string              { return c.path }
+func (c *clientRequest) GetBody() []byte              { return nil }
+func (c *clientRequest) GetHeaderParams() http.Header { return c.header }
+func (c *clientRequest) SetHeaderParam(k string, v ...string) error {
+	c.header[k] = v
+	return nil
+}
+
+func TestHMACAuth_AddAuthToClientRequest(t *testing.T) {
+	tm := time.Date(2019, time.January, 16, 14, 44, 45, 123, time.UTC)
+	u := User{Name: "Bicycle Repair Man"}
+	client := NewHMACAuth("mytype", []byte{1, 2, 3})
+	server := NewHMACAuth("mytype", []byte{1, 2, 3}, WithUser(u), WithLifetime(0), WithCanonicalRequest())
+
+	// the openapi request does not know the base path and the host
+	crq := &clientRequest{method: http.MethodGet, path: "/machine", header: http.Header{}}
+	require.NoError(t, client.AddAuthToClientRequest(crq, tm))
+	require.True(t, strings.HasPrefix(crq.header.Get(AuthzHeaderKey), "mytype "))
+
+	rq := httptest.NewRequest(http.MethodGet, "/v1/machine", nil)
+	for k, v := range crq.header {
+		rq.Header[k] = v
+	}
+	usr, err := server.User(rq)
+	require.NoError(t, err)
+	require.Equal(t, u.Name, usr.Name)
+
+	// the canonical request is never downgraded silently
+	client = NewHMACAuth("mytype", []byte{1, 2, 3}, WithCanonicalRequest())
+	crq = &clientRequest{method: http.MethodGet, path: "/machine", header: http.Header{}}
+	require.ErrorIs(t, client.AddAuthToClientRequest(crq, tm), ErrCanonicalRequestUnsupported)
+	require.Empty(t, crq.header)
+	require.Empty(t, client.AuthHeaders(http.MethodGet, tm))
+	require.Empty(t, client.AuthHeadersWithBody(http.MethodGet, tm, nil))
+}
+
+func TestHMACAuth_RequestAuthHeaders(t *testing.T) {
+	tm := time.Date(2019, time.January, 16, 14, 44, 45, 123, time.UTC)
+	u := User{Name: "Bicycle Repair Man"}
+	client := NewHMACAuth("mytype", []byte{1, 2, 3}, WithCanonicalRequest())
+	server := NewHMACAuth("mytype", []byte{1, 2, 3}, WithUser(u), WithLifetime(0), WithCanonicalRequest(), WithMinVersion(HMACVersion2))
+
+	_, err := client.RequestAuthHeaders(RequestData{Method: http.MethodGet}, tm)
+	require.ErrorIs(t, err, ErrCanonicalRequestUnsupported)
+
+	headers, err := client.RequestAuthHeaders(RequestData{
+		Method: http.MethodGet,
+		Path:   "/v1/machine",
+		Query:  url.Values{"id": []string{"1"}},
+		Host:   "example.com",
+	}, tm)
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(headers[AuthzHeaderKey], "mytype v=2,h=host,mac="))
+
+	rq := httptest.NewRequest(http.MethodGet, "http://example.com/v1/machine?id=1", nil)
+	for k, v := range headers {
+		rq.Header.Set(k, v)
+	}
+	usr, err := server.User(rq)
+	require.NoError(t, err)
+	require.Equal(t, u.Name, usr.Name)
+
+	// the signature is bound to the path
+	rq.URL.Path = "/v1/secret"
+	_, err = server.User(rq)
+	require.EqualError(t, err, "Wrong HMAC found")
+}
+
+func TestHMACAuth_UserWithNonceStore(t *testing.T) {
+	u := User{Name: "Bicycle Repair Man"}
+	ns := NewMemoryNonceStore(10)
+	hm := NewHMACAuth("mytype", []byte{1, 2, 3}, WithUser(u), WithNonceStore(ns))
+	other := NewHMACAuth("othertype", []byte{4, 5, 6}, WithUser(u), WithNonceStore(ns))
+
+	rq := httptest.NewRequest(http.MethodGet, "/myurl", nil)
+	hm.AddAuth(rq, time.Now(), nil)
+
+	usr, err := hm.User(rq)
+	require.NoError(t, err)
+	require.Equal(t, u.Name, usr.Name)
+
+	// the same request again is a replay
+	_, err = hm.User(rq)
+	require.ErrorIs(t, err, ErrReplayedRequest)
+
+	// the same salt with another authtype is no replay
+	orq := httptest.NewRequest(http.MethodGet, "/myurl", nil)
+	other.AddAuth(orq, time.Now(), nil)
+	_, err = other.User(orq)
+	require.NoError(t, err)
+
+	// a wrong hmac must not poison the nonce store
+	frq := httptest.NewRequest(http.MethodGet, "/myurl", nil)
+	frq.Header.Set(AuthzHeaderKey, "mytype 1234567")
+	frq.Header.Set(TsHeaderKey, time.Now().Format(time.RFC3339))
+	frq.Header.Set(SaltHeaderKey, "unused")
+	_, err = hm.User(frq)
+	var wrongHMAC *WrongHMAC
+	require.ErrorAs(t, err, &wrongHMAC)
+	fresh, err := ns.Add("mytype|unused", time.Time{})
+	require.NoError(t, err)
+	require.True(t, fresh)
+}
+
+func TestHMACAuth_UserWithKeyRing(t *testing.T) {
+	now := time.Now()
+	admin := User{Name: "Metal-Admin"}
+	viewer := User{Name: "Metal-Viewer"}
+	oldKey := HMACKey{ID: "2019", Key: []byte("old"), NotAfter: now.Add(time.Hour), User: &viewer}
+
+	server := NewHMACAuth("mytype", []byte("current"), WithUser(admin), WithKeyID("2020"), WithKeys(
+		oldKey,
+		HMACKey{ID: "2018", Key: []byte("expired"), NotAfter: now.Add(-time.Hour)},
+		HMACKey{ID: "", Key: []byte("legacy")},
+	))
+
+	testdata := []struct {
+		name       string
+		client     HMACAuth
+		wantHeader string
+		wantUser   string
+		wantErr    string
+	}{
+		{
+			name:       "current key",
+			client:     NewHMACAuth("mytype", []byte("current"), WithKeyID("2020")),
+			wantHeader: "mytype v=1,kid=2020,mac=",
+			wantUser:   admin.Name,
+		},
+		{
+			name:       "previous key with its own user",
+			client:     NewHMACAuth("mytype", []byte("old"), WithKeyID("2019")),
+			wantHeader: "mytype v=1,kid=2019,mac=",
+			wantUser:   viewer.Name,
+		},
+		{
+			name:       "legacy client without key id",
+			client:     NewHMACAuth("mytype", []byte("legacy")),
+			wantHeader: "mytype ",
+			wantUser:   admin.Name,
+		},
+		{
+			name:       "client switches to the scheduled key",
+			client:     NewHMACAuth("mytype", []byte("old"), WithKeyID("2019"), WithKeys(HMACKey{ID: "2020", Key: []byte("current"), NotBefore: now.Add(-time.Minute)})),
+			wantHeader: "mytype v=1,kid=2020,mac=",
+			wantUser:   admin.Name,
+		},
+		{
+			name:       "client does not use a key before it is valid",
+			client:     NewHMACAuth("mytype", []byte("old"), WithKeyID("2019"), WithKeys(HMACKey{ID: "2020", Key: []byte("current"), NotBefore: now.Add(time.Minute)})),
+			wantHeader: "mytype v=1,kid=2019,mac=",
+			wantUser:   viewer.Name,
+		},
+		{
+			name:    "expired key",
+			client:  NewHMACAuth("mytype", []byte("expired"), WithKeyID("2018")),
+			wantErr: "the key with id \"2018\" is not valid anymore",
+		},
+		{
+			name:    "unknown key",
+			client:  NewHMACAuth("mytype", []byte("current"), WithKeyID("2021")),
+			wantErr: "unknown key id \"2021\"",
+		},
+		{
+			name:    "wrong key for the id",
+			client:  NewHMACAuth("mytype", []byte("old"), WithKeyID("2020")),
+			wantErr: "Wrong HMAC found",
+		},
+	}
+
+	for _, st := range testdata {
+		t.Run(st.name, func(t *testing.T) {
+			rq := httptest.NewRequest(http.MethodGet, "/myurl", nil)
+			st.client.AddAuth(rq, now, nil)
+			require.True(t, strings.HasPrefix(rq.Header.Get(AuthzHeaderKey), st.wantHeader), rq.Header.Get(AuthzHeaderKey))
+
+			usr, err := server.User(rq)
+			if st.wantErr != "" {
+				require.EqualError(t, err, st.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, st.wantUser, usr.Name)
+		})
+	}
+}
+
+func TestHMACAuth_UserWithClockSkew(t *testing.T) {
+	tests := []struct {
+		name   string
+		offset time.Duration
+		want   bool
+	}{
+		{name: "in time", offset: 0, want: true},
+		{name: "within past tolerance", offset: -50 * time.Second, want: true},
+		{name: "within future tolerance", offset: 4 * time.Second, want: true},
+		{name: "too old", offset: -70 * time.Second},
+		{name: "too far in the future", offset: 10 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hm := NewHMACAuth("mytype", []byte{1, 2, 3}, WithClockSkew(time.Minute, 5*time.Second))
+			rq := httptest.NewRequest(http.MethodGet, "/myurl", nil)
+			client := time.Now().Add(tt.offset)
+			hm.AddAuth(rq, client, nil)
+
+			_, err := hm.User(rq)
+			if tt.want {
+				require.NoError(t, err)
+				return
+			}
+			var skew *ClockSkewError
+			require.ErrorAs(t, err, &skew)
+			require.Equal(t, client.UTC().Truncate(time.Second), skew.ClientTime.UTC())
+			require.WithinDuration(t, time.Now(), skew.ServerTime, time.Second)
+			require.Equal(t, time.Minute, skew.MaxPast)
+			require.Equal(t, 5*time.Second, skew.MaxFuture)
+		})
+	}
+}
+
+func TestHMACAuth_UserWithAlgorithm(t *testing.T) {
+	tests := []struct {
+		name    string
+		client  []HMACAuthOption
+		server  []HMACAuthOption
+		wantErr string
+	}{
+		{
+			name: "default algorithm",
+		},
+		{
+			name:   "sha384",
+			client: []HMACAuthOption{WithAlgorithm(HMACSHA384)},
+			server: []HMACAuthOption{WithAlgorithm(HMACSHA384)},
+		},
+		{
+			name:   "sha512",
+			client: []HMACAuthOption{WithAlgorithm(HMACSHA512)},
+			server: []HMACAuthOption{WithAlgorithm(HMACSHA512)},
+		},
+		{
+			name:   "blake2b",
+			client: []HMACAuthOption{WithAlgorithm(HMACBLAKE2b256), WithCanonicalRequest()},
+			server: []HMACAuthOption{WithAllowedAlgorithms(HMACSHA256, HMACBLAKE2b256)},
+		},
+		{
+			name:    "algorithm not allowed",
+			client:  []HMACAuthOption{WithAlgorithm(HMACSHA512)},
+			wantErr: "the hmac algorithm \"hmac-sha512\" is not accepted",
+		},
+		{
+			name:    "legacy clients are rejected",
+			server:  []HMACAuthOption{WithAlgorithm(HMACSHA512)},
+			wantErr: "the hmac algorithm \"hmac-sha256\" is not accepted",
+		},
+		{
+			name:    "unsupported client algorithm",
+			client:  []HMACAuthOption{WithAlgorithm("hmac-md5")},
+			wantErr: "no auth found",
+		},
+		{
+			name:    "unsupported server algorithm",
+			server:  []HMACAuthOption{WithAllowedAlgorithms(HMACSHA256, "hmac-md5")},
+			wantErr: "unsupported hmac algorithm \"hmac-md5\"",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := NewHMACAuth("mytype", []byte{1, 2, 3}, tt.client...)
+			server := NewHMACAuth("mytype", []byte{1, 2, 3}, tt.server...)
+			rq := httptest.NewRequest(http.MethodGet, "/myurl", nil)
+			client.AddAuth(rq, time.Now(), nil)
+
+			_, err := server.User(rq)
+			if tt.wantErr != "" {
+				require.EqualError(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+
+	hm := NewHMACAuth("mytype", []byte{1, 2, 3}, WithAlgorithm("hmac-md5"))
+	require.EqualError(t, hm.Err(), "unsupported hmac algorithm \"hmac-md5\"")
+	require.Empty(t, hm.AuthHeaders(http.MethodGet, time.Now()))
+	_, err := hm.User(httptest.NewRequest(http.MethodGet, "/myurl", nil))
+	var authErr *AuthError
+	require.ErrorAs(t, err, &authErr)
+	require.Equal(t, AuthErrorUnavailable, authErr.Kind)
+
+	// the algorithm of a HMACAuth which was not created by NewHMACAuth is only
+	// checked when signing
+	hm = HMACAuth{Type: "mytype", Algorithm: "hmac-md5"}
+	_, _, err = hm.create(time.Now())
+	require.EqualError(t, err, "unsupported hmac algorithm \"hmac-md5\"")
+	require.Empty(t, hm.AuthHeaders(http.MethodGet, time.Now()))
+}
+
 func TestMacCalc(t *testing.T) {
 	u := User{Name: "Bicycle Repair Man"}
 	hm := NewHMACAuth("mytype", []byte{1, 2, 3}, WithUser(u))
-	mac, ts := hm.create(time.Date(2019, time.January, 16, 14, 44, 45, 123, time.UTC), []byte{6, 7, 8, 9})
+	mac, ts, err := hm.create(time.Date(2019, time.January, 16, 14, 44, 45, 123, time.UTC), []byte{6, 7, 8, 9})
+	require.NoError(t, err)
 	expectmac := "bfb747058c7036befe1e32ce1d180099aa85951656e2164245b53e766074e262" // nolint:gosec
 	expectts := "2019-01-16T14:44:45Z"
 	if mac != expectmac {
@@ -274,7 +779,8 @@ func TestMacCalc2(t *testing.T) {
 			for _, d := range td.data {
 				data = append(data, []byte(d))
 			}
-			mac, _ := hm.create(dt, data...)
+			mac, _, err := hm.create(dt, data...)
+			require.NoError(t, err)
 			if mac != td.expected {
 				t.Fatalf("expected mac %q, but got %q", td.expected, mac)
 			}
@@ -289,3 +795,85 @@ func Test_randomByteString(t *testing.T) {
 	require.Len(t, randomByteString(32), 32)
 
 }
+
+// countingReader counts the bytes which are read from it.
+type countingReader struct {
+	r    io.Reader
+	read int
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.read += n
+	return n, err
+}
+
+func TestHMACAuth_UserReadsBodyAfterHMAC(t *testing.T) {
+	tm := time.Now()
+	mybody := []byte(`{"name":"my-machine"}`)
+
+	tests := []struct {
+		name     string
+		authz    func(hm *HMACAuth, rq *http.Request)
+		opts     []HMACAuthOption
+		wantErr  string
+		wantRead bool
+	}{
+		{
+			name:    "bearer token",
+			authz:   func(hm *HMACAuth, rq *http.Request) { rq.Header.Set(AuthzHeaderKey, "Bearer abc") },
+			wantErr: "unknown authtype found",
+		},
+		{
+			name: "wrong hmac",
+			authz: func(hm *HMACAuth, rq *http.Request) {
+				other := NewHMACAuth("mytype", []byte{4, 5, 6}, WithLifetime(0), WithBodyDigest())
+				other.AddAuth(rq, tm, mybody)
+			},
+			wantErr: "Wrong HMAC found",
+		},
+		{
+			name: "expired",
+			authz: func(hm *HMACAuth, rq *http.Request) {
+				hm.AddAuth(rq, tm.Add(-time.Hour), mybody)
+			},
+			wantErr: "the timestamp",
+		},
+		{
+			name:     "body too large",
+			authz:    func(hm *HMACAuth, rq *http.Request) { hm.AddAuth(rq, tm, mybody) },
+			opts:     []HMACAuthOption{WithMaxBodySize(10)},
+			wantErr:  "the request body is larger than 10 bytes",
+			wantRead: true,
+		},
+		{
+			name:     "valid",
+			authz:    func(hm *HMACAuth, rq *http.Request) { hm.AddAuth(rq, tm, mybody) },
+			wantRead: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hm := NewHMACAuth("mytype", []byte{1, 2, 3}, append([]HMACAuthOption{WithBodyDigest()}, tt.opts...)...)
+			body := &countingReader{r: bytes.NewReader(mybody)}
+			rq := httptest.NewRequest(http.MethodPost, "/myurl", body)
+			tt.authz(&hm, rq)
+
+			_, err := hm.User(rq)
+			if tt.wantErr != "" {
+				require.ErrorContains(t, err, tt.wantErr)
+			} else {
+				require.NoError(t, err)
+			}
+			require.Equal(t, tt.wantRead, body.read > 0)
+		})
+	}
+
+	var ae *AuthError
+	hm := NewHMACAuth("mytype", []byte{1, 2, 3}, WithBodyDigest(), WithMaxBodySize(10))
+	rq := httptest.NewRequest(http.MethodPost, "/myurl", bytes.NewReader(mybody))
+	hm.AddAuth(rq, tm, mybody)
+	_, err := hm.User(rq)
+	require.ErrorAs(t, err, &ae)
+	require.Equal(t, AuthErrorMalformed, ae.Kind)
+}
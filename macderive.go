@@ -0,0 +1,38 @@
+package security
+
+import (
+	"crypto/hkdf"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+)
+
+// A ClientResolver returns the user of the client with the given id. It is used
+// by a server which derives the keys of its clients from a master key.
+type ClientResolver func(clientID string) (*User, error)
+
+// StaticClients returns a ClientResolver which knows the given clients.
+func StaticClients(clients map[string]User) ClientResolver {
+	return func(clientID string) (*User, error) {
+		u, ok := clients[clientID]
+		if !ok {
+			return nil, fmt.Errorf("unknown client %q", clientID)
+		}
+		return &u, nil
+	}
+}
+
+// DeriveHMACKey derives the key of a client from the master key of a server
+// with HKDF-SHA256. Hand out the derived key to the client which uses it together
+// with WithClientID, so a compromised client cannot impersonate other clients.
+// The authtype is part of the derivation, so the same master key can be used for
+// different types.
+func DeriveHMACKey(master []byte, authtype, clientID string) ([]byte, error) {
+	if len(master) == 0 {
+		return nil, errors.New("no master key given")
+	}
+	if clientID == "" {
+		return nil, errors.New("no client id given")
+	}
+	return hkdf.Key(sha256.New, master, nil, "metal-stack hmac "+authtype+" "+clientID, sha256.Size)
+}
@@ -0,0 +1,103 @@
+package security
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeriveHMACKey(t *testing.T) {
+	master := []byte("master-secret")
+
+	k1, err := DeriveHMACKey(master, "metal-agent", "partition-1")
+	require.NoError(t, err)
+	require.Len(t, k1, 32)
+
+	again, err := DeriveHMACKey(master, "metal-agent", "partition-1")
+	require.NoError(t, err)
+	require.Equal(t, k1, again)
+
+	k2, err := DeriveHMACKey(master, "metal-agent", "partition-2")
+	require.NoError(t, err)
+	require.NotEqual(t, k1, k2)
+
+	k3, err := DeriveHMACKey(master, "metal-view", "partition-1")
+	require.NoError(t, err)
+	require.NotEqual(t, k1, k3)
+
+	_, err = DeriveHMACKey(nil, "metal-agent", "partition-1")
+	require.EqualError(t, err, "no master key given")
+	_, err = DeriveHMACKey(master, "metal-agent", "")
+	require.EqualError(t, err, "no client id given")
+}
+
+func TestHMACAuth_UserWithClientID(t *testing.T) {
+	master := []byte("master-secret")
+	clients := map[string]User{
+		"partition-1": {Name: "partition-1", Tenant: "t1", Project: "p1"},
+		"partition-2": {Name: "partition-2", Tenant: "t2", Project: "p2"},
+	}
+	server := NewHMACAuth("metal-agent", master, WithClientResolver(StaticClients(clients)))
+
+	derived := func(id string) []byte {
+		k, err := DeriveHMACKey(master, "metal-agent", id)
+		require.NoError(t, err)
+		return k
+	}
+
+	tests := []struct {
+		name     string
+		client   HMACAuth
+		server   HMACAuth
+		wantUser *User
+		wantErr  string
+	}{
+		{
+			name:     "derived key",
+			client:   NewHMACAuth("metal-agent", derived("partition-1"), WithClientID("partition-1")),
+			server:   server,
+			wantUser: &User{Name: "partition-1", Tenant: "t1", Project: "p1"},
+		},
+		{
+			name:    "impersonation of another client",
+			client:  NewHMACAuth("metal-agent", derived("partition-1"), WithClientID("partition-2")),
+			server:  server,
+			wantErr: "Wrong HMAC found",
+		},
+		{
+			name:    "unknown client",
+			client:  NewHMACAuth("metal-agent", derived("partition-3"), WithClientID("partition-3")),
+			server:  server,
+			wantErr: "unknown client \"partition-3\"",
+		},
+		{
+			name:    "master key without client id",
+			client:  NewHMACAuth("metal-agent", master),
+			server:  server,
+			wantErr: "no client id found in \"Authorization\" header",
+		},
+		{
+			name:    "client id without derived keys",
+			client:  NewHMACAuth("metal-agent", derived("partition-1"), WithClientID("partition-1")),
+			server:  NewHMACAuth("metal-agent", master),
+			wantErr: "client ids are not supported for hmac type \"metal-agent\"",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rq := httptest.NewRequest(http.MethodGet, "/myurl", nil)
+			tt.client.AddAuth(rq, time.Now(), nil)
+
+			u, err := tt.server.User(rq)
+			if tt.wantErr != "" {
+				require.EqualError(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.wantUser, u)
+		})
+	}
+}
@@ -0,0 +1,211 @@
+package security
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"fmt"
+	"hash"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// The versions of the hmac auth scheme.
+const (
+	// HMACVersion1 signs the timestamp, the method and the salt of the request.
+	HMACVersion1 = 1
+	// HMACVersion2 signs the canonical request, i.e. additionally the path,
+	// the sorted query and the selected headers of the request.
+	HMACVersion2 = 2
+)
+
+// The algorithms of the hmac auth scheme. The algorithm is transported in the
+// "alg" parameter of the "Authorization" header, a header without this
+// parameter is signed with HMACSHA256.
+const (
+	HMACSHA256     = "hmac-sha256"
+	HMACSHA384     = "hmac-sha384"
+	HMACSHA512     = "hmac-sha512"
+	HMACBLAKE2b256 = "hmac-blake2b-256"
+	HMACBLAKE2b512 = "hmac-blake2b-512"
+)
+
+var hmacAlgorithms = map[string]func() hash.Hash{
+	HMACSHA256: sha256.New,
+	HMACSHA384: sha512.New384,
+	HMACSHA512: sha512.New,
+	HMACBLAKE2b256: func() hash.Hash {
+		// blake2b only returns an error for keys which are too long
+		h, _ := blake2b.New256(nil)
+		return h
+	},
+	HMACBLAKE2b512: func() hash.Hash {
+		h, _ := blake2b.New512(nil)
+		return h
+	},
+}
+
+// hmacHash returns the hash function of the given algorithm.
+func hmacHash(alg string) (func() hash.Hash, error) {
+	h, ok := hmacAlgorithms[alg]
+	if !ok {
+		return nil, fmt.Errorf("unsupported hmac algorithm %q", alg)
+	}
+	return h, nil
+}
+
+// hmacParams are the parameters of a hmac authorization header. A version 1
+// header without any further parameters is transported in the legacy format
+// "<type> <mac>", all others as
+// "<type> v=<version>,alg=<algorithm>,kid=<key id>,cid=<client id>,h=<headers>,mac=<mac>".
+type hmacParams struct {
+	version  int
+	alg      string
+	keyID    string
+	clientID string
+	headers  []string
+	mac      string
+}
+
+// algorithm returns the algorithm of the mac, HMACSHA256 if none is set.
+func (p hmacParams) algorithm() string {
+	if p.alg == "" {
+		return HMACSHA256
+	}
+	return p.alg
+}
+
+func (p hmacParams) format(authtype string) string {
+	alg := p.algorithm()
+	if p.version <= HMACVersion1 && alg == HMACSHA256 && p.keyID == "" && p.clientID == "" && len(p.headers) == 0 {
+		return authtype + " " + p.mac
+	}
+	params := []string{"v=" + strconv.Itoa(p.version)}
+	if alg != HMACSHA256 {
+		params = append(params, "alg="+alg)
+	}
+	if p.keyID != "" {
+		params = append(params, "kid="+p.keyID)
+	}
+	if p.clientID != "" {
+		params = append(params, "cid="+p.clientID)
+	}
+	if len(p.headers) > 0 {
+		params = append(params, "h="+strings.Join(p.headers, ";"))
+	}
+	params = append(params, "mac="+p.mac)
+	return authtype + " " + strings.Join(params, ",")
+}
+
+// parseHMACParams parses the credentials part of a hmac authorization header.
+func parseHMACParams(credentials string) (*hmacParams, error) {
+	if !strings.Contains(credentials, "=") {
+		return &hmacParams{version: HMACVersion1, mac: credentials}, nil
+	}
+	p := &hmacParams{version: HMACVersion1}
+	for param := range strings.SplitSeq(credentials, ",") {
+		k, v, ok := strings.Cut(strings.TrimSpace(param), "=")
+		if !ok || v == "" {
+			return nil, fmt.Errorf("illegal parameter %q in %q header", param, AuthzHeaderKey)
+		}
+		switch k {
+		case "v":
+			version, err := strconv.Atoi(v)
+			if err != nil || version < HMACVersion1 || version > HMACVersion2 {
+				return nil, fmt.Errorf("unsupported hmac version %q", v)
+			}
+			p.version = version
+		case "alg":
+			alg := strings.ToLower(v)
+			if _, err := hmacHash(alg); err != nil {
+				return nil, err
+			}
+			p.alg = alg
+		case "kid":
+			p.keyID = v
+		case "cid":
+			p.clientID = v
+		case "h":
+			p.headers = strings.Split(strings.ToLower(v), ";")
+		case "mac":
+			p.mac = v
+		default:
+			return nil, fmt.Errorf("unknown parameter %q in %q header", k, AuthzHeaderKey)
+		}
+	}
+	if p.mac == "" {
+		return nil, fmt.Errorf("no mac found in %q header", AuthzHeaderKey)
+	}
+	if p.version == HMACVersion1 && len(p.headers) > 0 {
+		return nil, fmt.Errorf("hmac version %d does not support signed headers", HMACVersion1)
+	}
+	return p, nil
+}
+
+// signedHeaders returns the normalized list of headers which are signed in
+// the canonical request. The host is always signed.
+func signedHeaders(headers []string) []string {
+	return signedHeadersWith("host", headers)
+}
+
+// signedHeadersWith returns the normalized list of the first header and the
+// given headers.
+func signedHeadersWith(first string, headers []string) []string {
+	res := []string{strings.ToLower(first)}
+	for _, h := range headers {
+		h = strings.ToLower(strings.TrimSpace(h))
+		if h != "" && !slices.Contains(res, h) {
+			res = append(res, h)
+		}
+	}
+	return res
+}
+
+// canonicalRequest returns the canonical form of the request data which is
+// signed in version 2 of the scheme. Every element is placed on its own line,
+// so the result starts with a newline to separate it from the timestamp.
+func canonicalRequest(rqd RequestData, headers []string) string {
+	var sb strings.Builder
+	path := rqd.Path
+	if path == "" {
+		path = "/"
+	}
+	sb.WriteString("\n" + rqd.Method)
+	sb.WriteString("\n" + path)
+	sb.WriteString("\n" + canonicalQuery(rqd.Query))
+	for _, h := range headers {
+		var v string
+		if h == "host" {
+			v = rqd.Host
+		} else {
+			v = strings.Join(rqd.Header.Values(h), ",")
+		}
+		sb.WriteString("\n" + h + ":" + strings.TrimSpace(v))
+	}
+	sb.WriteString("\n" + rqd.SaltHeader)
+	return sb.String()
+}
+
+// canonicalQuery encodes the query sorted by key and value.
+func canonicalQuery(q url.Values) string {
+	sorted := make(url.Values, len(q))
+	for k, vs := range q {
+		sorted[k] = slices.Sorted(slices.Values(vs))
+	}
+	return sorted.Encode()
+}
+
+// requestHost returns the host the client sends the request to.
+func requestHost(rq *http.Request) string {
+	if rq.Host != "" {
+		return rq.Host
+	}
+	if rq.URL != nil {
+		return rq.URL.Host
+	}
+	return ""
+}
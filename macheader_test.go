@@ -0,0 +1,120 @@
+package security
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_parseHMACParams(t *testing.T) {
+	tests := []struct {
+		name        string
+		credentials string
+		want        *hmacParams
+		wantErr     string
+	}{
+		{
+			name:        "legacy format",
+			credentials: "f8d293a06bdde899",
+			want:        &hmacParams{version: HMACVersion1, mac: "f8d293a06bdde899"},
+		},
+		{
+			name:        "version 2 with headers",
+			credentials: "v=2,h=host;Content-Type,mac=f8d293a06bdde899",
+			want:        &hmacParams{version: HMACVersion2, headers: []string{"host", "content-type"}, mac: "f8d293a06bdde899"},
+		},
+		{
+			name:        "version 1 with key id",
+			credentials: "v=1,kid=2020,mac=f8d293a06bdde899",
+			want:        &hmacParams{version: HMACVersion1, keyID: "2020", mac: "f8d293a06bdde899"},
+		},
+		{
+			name:        "algorithm",
+			credentials: "v=1,alg=HMAC-SHA512,mac=f8d293a06bdde899",
+			want:        &hmacParams{version: HMACVersion1, alg: HMACSHA512, mac: "f8d293a06bdde899"},
+		},
+		{
+			name:        "unsupported algorithm",
+			credentials: "v=1,alg=hmac-md5,mac=f8d293a06bdde899",
+			wantErr:     "unsupported hmac algorithm \"hmac-md5\"",
+		},
+		{
+			name:        "client id",
+			credentials: "v=1,kid=2020,cid=agent-1,mac=f8d293a06bdde899",
+			want:        &hmacParams{version: HMACVersion1, keyID: "2020", clientID: "agent-1", mac: "f8d293a06bdde899"},
+		},
+		{
+			name:        "unsupported version",
+			credentials: "v=3,mac=f8d293a06bdde899",
+			wantErr:     "unsupported hmac version \"3\"",
+		},
+		{
+			name:        "unknown parameter",
+			credentials: "v=2,foo=bar,mac=f8d293a06bdde899",
+			wantErr:     "unknown parameter \"foo\" in \"Authorization\" header",
+		},
+		{
+			name:        "missing mac",
+			credentials: "v=2,h=host",
+			wantErr:     "no mac found in \"Authorization\" header",
+		},
+		{
+			name:        "empty parameter",
+			credentials: "v=2,h=,mac=f8d293a06bdde899",
+			wantErr:     "illegal parameter \"h=\" in \"Authorization\" header",
+		},
+		{
+			name:        "headers in version 1",
+			credentials: "v=1,h=host,mac=f8d293a06bdde899",
+			wantErr:     "hmac version 1 does not support signed headers",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseHMACParams(tt.credentials)
+			if tt.wantErr != "" {
+				require.EqualError(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func Test_hmacParams_format(t *testing.T) {
+	p := hmacParams{version: HMACVersion1, mac: "abc"}
+	require.Equal(t, "mytype abc", p.format("mytype"))
+
+	p = hmacParams{version: HMACVersion2, headers: []string{"host", "content-type"}, mac: "abc"}
+	require.Equal(t, "mytype v=2,h=host;content-type,mac=abc", p.format("mytype"))
+
+	parsed, err := parseHMACParams("v=2,h=host;content-type,mac=abc")
+	require.NoError(t, err)
+	require.Equal(t, p, *parsed)
+
+	p = hmacParams{version: HMACVersion1, alg: HMACSHA256, mac: "abc"}
+	require.Equal(t, "mytype abc", p.format("mytype"))
+
+	p = hmacParams{version: HMACVersion1, alg: HMACBLAKE2b256, mac: "abc"}
+	require.Equal(t, "mytype v=1,alg=hmac-blake2b-256,mac=abc", p.format("mytype"))
+}
+
+func Test_canonicalRequest(t *testing.T) {
+	rqd := RequestData{
+		Method:     http.MethodGet,
+		SaltHeader: "salt",
+		Path:       "/v1/machine/find",
+		Query:      url.Values{"b": []string{"2", "1"}, "a": []string{"x y"}},
+		Host:       "metal-api.example.com",
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+	}
+	want := "\nGET\n/v1/machine/find\na=x+y&b=1&b=2\nhost:metal-api.example.com\ncontent-type:application/json\nsalt"
+	require.Equal(t, want, canonicalRequest(rqd, signedHeaders([]string{"Content-Type"})))
+
+	rqd.Path = ""
+	rqd.Query = nil
+	require.Equal(t, "\nGET\n/\n\nhost:metal-api.example.com\nsalt", canonicalRequest(rqd, signedHeaders(nil)))
+}
@@ -0,0 +1,152 @@
+package security
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Middleware authenticates the requests of a http.Handler with a UserGetter,
+// e.g. UserCreds, and puts the user into the context of the request.
+type Middleware struct {
+	ug        UserGetter
+	required  bool
+	skipPaths []string
+	realm     string
+}
+
+// MiddlewareOption is a option type for Middleware
+type MiddlewareOption func(*Middleware)
+
+// NewMiddleware returns a new Middleware which authenticates the requests with
+// the given UserGetter.
+func NewMiddleware(ug UserGetter, opts ...MiddlewareOption) *Middleware {
+	m := &Middleware{ug: ug}
+	for _, o := range opts {
+		o(m)
+	}
+	return m
+}
+
+// WithRequiredAuthentication rejects requests which are not authenticated,
+// instead of passing them as a guest to the next handler.
+func WithRequiredAuthentication() MiddlewareOption {
+	return func(m *Middleware) {
+		m.required = true
+	}
+}
+
+// WithSkipPaths sets the paths which are passed to the next handler without
+// authentication, e.g. "/healthz". A path which ends with a slash skips all
+// paths below it.
+func WithSkipPaths(paths ...string) MiddlewareOption {
+	return func(m *Middleware) {
+		m.skipPaths = append(m.skipPaths, paths...)
+	}
+}
+
+// WithRealm sets the realm of the "WWW-Authenticate" header.
+func WithRealm(realm string) MiddlewareOption {
+	return func(m *Middleware) {
+		m.realm = realm
+	}
+}
+
+// Handler returns a http.Handler which authenticates the requests before they
+// are passed to the next handler. Requests which cannot be authenticated are
+// rejected with the status 401 and a "WWW-Authenticate" header as described in
+// RFC 6750. The context of the request contains an AuthTrace, which is filled
+// by a UserCreds with WithAuthTrace.
+func (m *Middleware) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, rq *http.Request) {
+		if m.skip(rq.URL.Path) {
+			next.ServeHTTP(w, rq)
+			return
+		}
+		if AuthTraceFromContext(rq.Context()) == nil {
+			ctx, _ := ContextWithAuthTrace(rq.Context())
+			rq = rq.WithContext(ctx)
+		}
+		u, err := m.ug.User(rq)
+		if err != nil {
+			m.fail(w, err)
+			return
+		}
+		if m.required && u.IsAnonymous() {
+			m.challenge(w, http.StatusUnauthorized, "", "")
+			return
+		}
+		next.ServeHTTP(w, rq.WithContext(PutUserInContext(rq.Context(), u)))
+	})
+}
+
+func (m *Middleware) skip(path string) bool {
+	for _, p := range m.skipPaths {
+		if path == p || (strings.HasSuffix(p, "/") && strings.HasPrefix(path, p)) {
+			return true
+		}
+	}
+	return false
+}
+
+// fail writes the response for a request which could not be authenticated. The
+// status is taken from the AuthError, a request without credentials gets a
+// challenge without an error code.
+func (m *Middleware) fail(w http.ResponseWriter, err error) {
+	status, code := http.StatusUnauthorized, "invalid_token"
+	var ae *AuthError
+	if errors.As(err, &ae) {
+		status = ae.Status()
+		switch ae.Kind {
+		case AuthErrorNoCredentials:
+			code = ""
+		case AuthErrorMalformed:
+			code = "invalid_request"
+		}
+	}
+	if status != http.StatusUnauthorized && status != http.StatusBadRequest {
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+	m.challenge(w, status, code, err.Error())
+}
+
+// challenge writes a response with a "WWW-Authenticate" header.
+func (m *Middleware) challenge(w http.ResponseWriter, status int, code, description string) {
+	if code == "" {
+		description = ""
+	}
+	w.Header().Set("WWW-Authenticate", bearerChallenge(m.realm, code, description))
+	http.Error(w, http.StatusText(status), status)
+}
+
+// bearerChallenge returns the value of a "WWW-Authenticate" header for the
+// bearer scheme of RFC 6750.
+func bearerChallenge(realm, code, description string) string {
+	var params []string
+	if realm != "" {
+		params = append(params, fmt.Sprintf("realm=%q", challengeValue(realm)))
+	}
+	if code != "" {
+		params = append(params, fmt.Sprintf("error=%q", code))
+	}
+	if description != "" {
+		params = append(params, fmt.Sprintf("error_description=%q", challengeValue(description)))
+	}
+	if len(params) == 0 {
+		return "Bearer"
+	}
+	return "Bearer " + strings.Join(params, ", ")
+}
+
+// challengeValue removes the characters which are not allowed in the values of
+// a challenge, i.e. quotes, backslashes and control characters.
+func challengeValue(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r < 0x20 || r > 0x7e || r == '"' || r == '\\' {
+			return -1
+		}
+		return r
+	}, s)
+}
@@ -0,0 +1,157 @@
+package security
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMiddleware(t *testing.T) {
+	u := User{Name: "Bicycle Repair Man"}
+	hma := NewHMACAuth("mytype", []byte{1, 2, 3}, WithUser(u))
+	creds := NewCreds(WithHMAC(hma))
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, rq *http.Request) {
+		_, _ = w.Write([]byte(GetUser(rq).Name))
+	})
+
+	tests := []struct {
+		name          string
+		opts          []MiddlewareOption
+		path          string
+		auth          func(rq *http.Request)
+		wantStatus    int
+		wantBody      string
+		wantChallenge string
+	}{
+		{
+			name:       "authenticated",
+			path:       "/v1/machine",
+			auth:       func(rq *http.Request) { hma.AddAuth(rq, time.Now(), nil) },
+			wantStatus: http.StatusOK,
+			wantBody:   u.Name,
+		},
+		{
+			name:       "guest",
+			path:       "/v1/machine",
+			wantStatus: http.StatusOK,
+			wantBody:   "anonymous",
+		},
+		{
+			name:          "guest with required authentication",
+			opts:          []MiddlewareOption{WithRequiredAuthentication(), WithRealm("metal-api")},
+			path:          "/v1/machine",
+			wantStatus:    http.StatusUnauthorized,
+			wantChallenge: `Bearer realm="metal-api"`,
+		},
+		{
+			name:       "skipped path",
+			opts:       []MiddlewareOption{WithRequiredAuthentication(), WithSkipPaths("/healthz", "/metrics/")},
+			path:       "/healthz",
+			wantStatus: http.StatusOK,
+			wantBody:   "anonymous",
+		},
+		{
+			name:       "skipped path prefix",
+			opts:       []MiddlewareOption{WithRequiredAuthentication(), WithSkipPaths("/healthz", "/metrics/")},
+			path:       "/metrics/go",
+			wantStatus: http.StatusOK,
+			wantBody:   "anonymous",
+		},
+		{
+			name:          "path which is not skipped",
+			opts:          []MiddlewareOption{WithRequiredAuthentication(), WithSkipPaths("/healthz", "/metrics/")},
+			path:          "/healthz/deep",
+			wantStatus:    http.StatusUnauthorized,
+			wantChallenge: "Bearer",
+		},
+		{
+			name: "invalid credentials",
+			opts: []MiddlewareOption{WithRealm("metal-api")},
+			path: "/v1/machine",
+			auth: func(rq *http.Request) {
+				wrong := NewHMACAuth("mytype", []byte{4, 5, 6})
+				wrong.AddAuth(rq, time.Now(), nil)
+			},
+			wantStatus:    http.StatusUnauthorized,
+			wantChallenge: `Bearer realm="metal-api", error="invalid_token", error_description="Wrong HMAC found"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rq := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			if tt.auth != nil {
+				tt.auth(rq)
+			}
+			rec := httptest.NewRecorder()
+			NewMiddleware(creds, tt.opts...).Handler(next).ServeHTTP(rec, rq)
+
+			require.Equal(t, tt.wantStatus, rec.Code)
+			require.Equal(t, tt.wantChallenge, rec.Header().Get("WWW-Authenticate"))
+			if tt.wantBody != "" {
+				require.Equal(t, tt.wantBody, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestMiddleware_AuthErrors(t *testing.T) {
+	tests := []struct {
+		name          string
+		err           error
+		wantStatus    int
+		wantChallenge string
+	}{
+		{
+			name:          "no credentials",
+			err:           errNoAuthFound,
+			wantStatus:    http.StatusUnauthorized,
+			wantChallenge: "Bearer",
+		},
+		{
+			name:          "malformed",
+			err:           &AuthError{Kind: AuthErrorMalformed, Err: errors.New("illegal token")},
+			wantStatus:    http.StatusBadRequest,
+			wantChallenge: `Bearer error="invalid_request", error_description="illegal token"`,
+		},
+		{
+			name:          "expired",
+			err:           &AuthError{Kind: AuthErrorExpired, Err: errors.New("token is expired")},
+			wantStatus:    http.StatusUnauthorized,
+			wantChallenge: `Bearer error="invalid_token", error_description="token is expired"`,
+		},
+		{
+			name:       "unavailable",
+			err:        &AuthError{Kind: AuthErrorUnavailable, Err: errors.New("cannot fetch keys")},
+			wantStatus: http.StatusServiceUnavailable,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ug := failingUserGetter{err: tt.err}
+			rec := httptest.NewRecorder()
+			NewMiddleware(ug).Handler(http.NotFoundHandler()).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+
+			require.Equal(t, tt.wantStatus, rec.Code)
+			require.Equal(t, tt.wantChallenge, rec.Header().Get("WWW-Authenticate"))
+		})
+	}
+}
+
+type failingUserGetter struct {
+	err error
+}
+
+func (f failingUserGetter) User(*http.Request) (*User, error) {
+	return nil, f.err
+}
+
+func Test_bearerChallenge(t *testing.T) {
+	require.Equal(t, "Bearer", bearerChallenge("", "", ""))
+	require.Equal(t, `Bearer error="invalid_token", error_description="unknown timestamp x in X-Date header"`,
+		bearerChallenge("", "invalid_token", "unknown timestamp \"x\" in \"X-Date\" header\n"))
+}
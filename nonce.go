@@ -0,0 +1,98 @@
+package security
+
+import (
+	"container/list"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrReplayedRequest is returned by HMACAuth if the salt of a request was
+// already accepted before, i.e. the request is replayed.
+var ErrReplayedRequest = errors.New("the salt of the request was already used, possible replay detected")
+
+// A NonceStore remembers the salts of accepted requests, so a HMACAuth can
+// reject requests which are replayed within their lifetime. An implementation
+// must be safe for concurrent use.
+type NonceStore interface {
+	// Add stores the nonce until it expires. A zero expiry means that the nonce
+	// never expires. It returns false if the nonce is already stored and not
+	// expired yet.
+	Add(nonce string, expires time.Time) (bool, error)
+}
+
+// MemoryNonceStore is an in memory NonceStore. It holds at most a fixed number of
+// nonces and evicts the oldest ones if the capacity is reached, so choose the
+// capacity large enough to hold all requests within the lifetime of a HMACAuth.
+type MemoryNonceStore struct {
+	lock     sync.Mutex
+	capacity int
+	entries  map[string]*list.Element
+	order    *list.List
+	now      func() time.Time
+}
+
+type nonceEntry struct {
+	nonce   string
+	expires time.Time
+}
+
+// NewMemoryNonceStore returns a new MemoryNonceStore with the given capacity. If
+// the capacity is not positive, a default of 100000 nonces is used.
+func NewMemoryNonceStore(capacity int) *MemoryNonceStore {
+	if capacity <= 0 {
+		capacity = 100000
+	}
+	return &MemoryNonceStore{
+		capacity: capacity,
+		entries:  make(map[string]*list.Element),
+		order:    list.New(),
+		now:      time.Now,
+	}
+}
+
+// Add implements the NonceStore.
+func (m *MemoryNonceStore) Add(nonce string, expires time.Time) (bool, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	now := m.now()
+	if e, ok := m.entries[nonce]; ok {
+		entry := e.Value.(*nonceEntry)
+		if entry.expires.IsZero() || entry.expires.After(now) {
+			return false, nil
+		}
+		m.remove(e)
+	}
+	m.expire(now)
+	for m.order.Len() >= m.capacity {
+		m.remove(m.order.Front())
+	}
+	m.entries[nonce] = m.order.PushBack(&nonceEntry{nonce: nonce, expires: expires})
+	return true, nil
+}
+
+// Len returns the number of stored nonces.
+func (m *MemoryNonceStore) Len() int {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.order.Len()
+}
+
+// expire removes the expired nonces from the front of the list. Nonces are
+// added in the order of their arrival and mostly share the same lifetime, so
+// this stops at the first nonce which is not expired.
+func (m *MemoryNonceStore) expire(now time.Time) {
+	for e := m.order.Front(); e != nil; e = m.order.Front() {
+		entry := e.Value.(*nonceEntry)
+		if entry.expires.IsZero() || entry.expires.After(now) {
+			return
+		}
+		m.remove(e)
+	}
+}
+
+func (m *MemoryNonceStore) remove(e *list.Element) {
+	entry := m.order.Remove(e).(*nonceEntry)
+	delete(m.entries, entry.nonce)
+}
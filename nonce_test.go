@@ -0,0 +1,60 @@
+package security
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryNonceStore_Add(t *testing.T) {
+	now := time.Date(2019, time.January, 16, 14, 44, 45, 0, time.UTC)
+	ns := NewMemoryNonceStore(3)
+	ns.now = func() time.Time { return now }
+
+	fresh, err := ns.Add("a", now.Add(10*time.Second))
+	require.NoError(t, err)
+	require.True(t, fresh)
+
+	fresh, err = ns.Add("a", now.Add(10*time.Second))
+	require.NoError(t, err)
+	require.False(t, fresh, "a stored nonce must not be accepted again")
+
+	// after the expiry the nonce is accepted again
+	now = now.Add(11 * time.Second)
+	fresh, err = ns.Add("a", now.Add(10*time.Second))
+	require.NoError(t, err)
+	require.True(t, fresh)
+	require.Equal(t, 1, ns.Len())
+
+	// nonces without expiry are kept until they are evicted
+	fresh, err = ns.Add("b", time.Time{})
+	require.NoError(t, err)
+	require.True(t, fresh)
+	now = now.Add(time.Hour)
+	fresh, err = ns.Add("b", time.Time{})
+	require.NoError(t, err)
+	require.False(t, fresh)
+	fresh, err = ns.Add("c", now.Add(10*time.Second))
+	require.NoError(t, err)
+	require.True(t, fresh)
+	require.Equal(t, 2, ns.Len(), "the expired nonce 'a' must be removed")
+}
+
+func TestMemoryNonceStore_Capacity(t *testing.T) {
+	ns := NewMemoryNonceStore(2)
+	for _, n := range []string{"a", "b", "c"} {
+		fresh, err := ns.Add(n, time.Time{})
+		require.NoError(t, err)
+		require.True(t, fresh)
+	}
+	require.Equal(t, 2, ns.Len())
+
+	// the oldest nonce was evicted
+	fresh, err := ns.Add("a", time.Time{})
+	require.NoError(t, err)
+	require.True(t, fresh)
+	fresh, err = ns.Add("c", time.Time{})
+	require.NoError(t, err)
+	require.False(t, fresh)
+}
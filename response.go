@@ -0,0 +1,201 @@
+package security
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ResponseSignatureHeaderKey is the header which contains the hmac of a signed
+// response. The timestamp and the digest of the body are sent in the "X-Date"
+// and "Content-Digest" headers.
+const ResponseSignatureHeaderKey = "X-Response-Signature"
+
+// SignResponses is a middleware which signs the responses of the next handler
+// with the key which is used for the requests. The response is buffered to
+// calculate the digest of the body, so do not use it for streaming responses.
+func (hma *HMACAuth) SignResponses(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, rq *http.Request) {
+		bw := &bufferedResponseWriter{ResponseWriter: w}
+		next.ServeHTTP(bw, rq)
+		if bw.status == 0 {
+			bw.status = http.StatusOK
+		}
+
+		body := bw.body.Bytes()
+		headers := w.Header()
+		headers.Set(DigestHeaderKey, contentDigest(body))
+		sig, ts, err := hma.signResponse(rq, bw.status, headers, time.Now())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		headers.Set(TsHeaderKey, ts)
+		headers.Set(ResponseSignatureHeaderKey, sig)
+		headers.Set("Content-Length", strconv.Itoa(len(body)))
+		w.WriteHeader(bw.status)
+		_, _ = w.Write(body)
+	})
+}
+
+// signResponse returns the signature and the timestamp of a response to the
+// given request. If the request was signed by a client with a derived key, the
+// response is signed with the key of this client.
+func (hma *HMACAuth) signResponse(rq *http.Request, status int, header http.Header, t time.Time) (string, string, error) {
+	key := hma.signingKey(t)
+	if hma.clients != nil {
+		_, credentials, _ := strings.Cut(rq.Header.Get(AuthzHeaderKey), " ")
+		if p, err := parseHMACParams(credentials); err == nil && p.clientID != "" {
+			key.Key, err = DeriveHMACKey(key.Key, hma.Type, p.clientID)
+			if err != nil {
+				return "", "", err
+			}
+		}
+	}
+	params := hmacParams{
+		version: HMACVersion2,
+		alg:     hma.Algorithm,
+		keyID:   key.ID,
+		headers: signedResponseHeaders(hma.ResponseHeaders),
+	}
+	data := canonicalResponse(status, rq.Header.Get(SaltHeaderKey), header, params.headers)
+	mac, ts, err := hma.createWithKey(key.Key, params.algorithm(), t, data)
+	if err != nil {
+		return "", "", err
+	}
+	params.mac = mac
+	return params.format(hma.Type), ts, nil
+}
+
+// VerifyResponse checks the signature of a response to a request which was
+// signed by this HMACAuth. The body of the response is read and replaced by a
+// buffered copy.
+func (hma *HMACAuth) VerifyResponse(rsp *http.Response) error {
+	sig := rsp.Header.Get(ResponseSignatureHeaderKey)
+	if sig == "" {
+		return fmt.Errorf("no %q header found, the response is not signed", ResponseSignatureHeaderKey)
+	}
+	authtype, credentials, ok := strings.Cut(sig, " ")
+	if !ok || authtype != hma.Type {
+		return fmt.Errorf("illegal %q header", ResponseSignatureHeaderKey)
+	}
+	params, err := parseHMACParams(credentials)
+	if err != nil {
+		return err
+	}
+	if !slices.Contains(hma.allowedAlgorithms(), params.algorithm()) {
+		return fmt.Errorf("the hmac algorithm %q is not accepted", params.algorithm())
+	}
+	for _, h := range signedResponseHeaders(hma.ResponseHeaders) {
+		if !slices.Contains(params.headers, h) {
+			return fmt.Errorf("the response header %q must be signed", h)
+		}
+	}
+
+	t := rsp.Header.Get(TsHeaderKey)
+	ts, err := time.Parse(time.RFC3339, t)
+	if err != nil {
+		return fmt.Errorf("unknown timestamp %q in %q header of the response: %w", t, TsHeaderKey, err)
+	}
+	if hma.Lifetime > 0 {
+		now := time.Now()
+		if now.Sub(ts) > hma.Lifetime || ts.Sub(now) > hma.FutureSkew {
+			return fmt.Errorf("the timestamp %q of the response is not within the accepted clock skew, client time is %q", t, now.UTC().Format(time.RFC3339))
+		}
+	}
+
+	body, err := readResponseBody(rsp)
+	if err != nil {
+		return err
+	}
+	digest := rsp.Header.Get(DigestHeaderKey)
+	if digest == "" {
+		return fmt.Errorf("no %q header found in the response", DigestHeaderKey)
+	}
+	if err := verifyContentDigest(digest, body); err != nil {
+		return err
+	}
+
+	keys, err := hma.verificationKeys(params.keyID)
+	if err != nil {
+		return err
+	}
+	var salt string
+	if rsp.Request != nil {
+		salt = rsp.Request.Header.Get(SaltHeaderKey)
+	}
+	data := canonicalResponse(rsp.StatusCode, salt, rsp.Header, params.headers)
+	var calc string
+	for _, k := range keys {
+		c, _, err := hma.createWithKey(k.Key, params.algorithm(), ts, data)
+		if err != nil {
+			return err
+		}
+		if hmac.Equal([]byte(c), []byte(params.mac)) {
+			return nil
+		}
+		if calc == "" {
+			calc = c
+		}
+	}
+	return newWrongHMAC(params.mac, calc)
+}
+
+// signedResponseHeaders returns the normalized list of response headers which
+// are signed. The digest of the body is always signed.
+func signedResponseHeaders(headers []string) []string {
+	return signedHeadersWith(DigestHeaderKey, headers)
+}
+
+// canonicalResponse returns the canonical form of a response which is signed.
+func canonicalResponse(status int, salt string, header http.Header, headers []string) []byte {
+	var sb strings.Builder
+	sb.WriteString("\n" + strconv.Itoa(status))
+	sb.WriteString("\n" + salt)
+	for _, h := range headers {
+		sb.WriteString("\n" + h + ":" + strings.TrimSpace(strings.Join(header.Values(h), ",")))
+	}
+	return []byte(sb.String())
+}
+
+// readResponseBody reads the body of the response and replaces it with a
+// buffered copy.
+func readResponseBody(rsp *http.Response) ([]byte, error) {
+	if rsp.Body == nil || rsp.Body == http.NoBody {
+		return nil, nil
+	}
+	body, err := io.ReadAll(rsp.Body)
+	_ = rsp.Body.Close()
+	if err != nil {
+		return nil, fmt.Errorf("cannot read response body: %w", err)
+	}
+	rsp.Body = io.NopCloser(bytes.NewReader(body))
+	return body, nil
+}
+
+// bufferedResponseWriter buffers the status and the body of a response, the
+// headers are written to the underlying http.ResponseWriter.
+type bufferedResponseWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (b *bufferedResponseWriter) WriteHeader(status int) {
+	if b.status == 0 {
+		b.status = status
+	}
+}
+
+func (b *bufferedResponseWriter) Write(p []byte) (int, error) {
+	if b.status == 0 {
+		b.status = http.StatusOK
+	}
+	return b.body.Write(p)
+}
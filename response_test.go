@@ -0,0 +1,183 @@
+package security
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHMACAuth_SignResponses(t *testing.T) {
+	useRandomSalt(t)
+	server := NewHMACAuth("mytype", []byte{1, 2, 3}, WithSignedResponses("Content-Type"))
+	client := NewHMACAuth("mytype", []byte{1, 2, 3}, WithSignedResponses("Content-Type"))
+
+	var tamper func(w http.ResponseWriter)
+	handler := server.SignResponses(http.HandlerFunc(func(w http.ResponseWriter, rq *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write([]byte("created"))
+	}))
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, rq *http.Request) {
+		if tamper != nil {
+			tamper(w)
+			return
+		}
+		handler.ServeHTTP(w, rq)
+	}))
+	defer srv.Close()
+
+	c := &http.Client{Transport: NewHMACRoundTripper(client, nil)}
+	get := func() (string, error) {
+		rq, err := http.NewRequestWithContext(context.Background(), http.MethodGet, srv.URL, nil)
+		require.NoError(t, err)
+		rsp, err := c.Do(rq)
+		if err != nil {
+			return "", err
+		}
+		defer rsp.Body.Close()
+		require.Equal(t, http.StatusCreated, rsp.StatusCode)
+		body, err := io.ReadAll(rsp.Body)
+		require.NoError(t, err)
+		return string(body), nil
+	}
+
+	body, err := get()
+	require.NoError(t, err)
+	require.Equal(t, "created", body)
+
+	tamper = func(w http.ResponseWriter) {
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write([]byte("unsigned"))
+	}
+	_, err = get()
+	require.ErrorContains(t, err, "cannot verify response: no \"X-Response-Signature\" header found, the response is not signed")
+
+	// a response which is replayed for another request is rejected
+	rec := httptest.NewRecorder()
+	rq := httptest.NewRequest(http.MethodGet, "/", nil)
+	rq.Header.Set(SaltHeaderKey, "another-salt")
+	handler.ServeHTTP(rec, rq)
+	tamper = func(w http.ResponseWriter) {
+		for k, v := range rec.Header() {
+			w.Header()[k] = v
+		}
+		w.WriteHeader(rec.Code)
+		_, _ = w.Write(rec.Body.Bytes())
+	}
+	_, err = get()
+	var wrong *WrongHMAC
+	require.ErrorAs(t, err, &wrong)
+}
+
+func TestHMACAuth_VerifyResponse(t *testing.T) {
+	server := NewHMACAuth("mytype", []byte{1, 2, 3}, WithSignedResponses("Content-Type"))
+
+	signed := func(t *testing.T) *http.Response {
+		rq := httptest.NewRequest(http.MethodGet, "/", nil)
+		rq.Header.Set(SaltHeaderKey, "salt")
+		rec := httptest.NewRecorder()
+		server.SignResponses(http.HandlerFunc(func(w http.ResponseWriter, rq *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write([]byte(`{"id":"1"}`))
+		})).ServeHTTP(rec, rq)
+		rsp := rec.Result()
+		rsp.Request = rq
+		return rsp
+	}
+
+	tests := []struct {
+		name    string
+		client  HMACAuth
+		modify  func(rsp *http.Response)
+		wantErr string
+	}{
+		{
+			name:   "valid",
+			client: NewHMACAuth("mytype", []byte{1, 2, 3}),
+		},
+		{
+			name:   "tampered body",
+			client: NewHMACAuth("mytype", []byte{1, 2, 3}),
+			modify: func(rsp *http.Response) {
+				rsp.Body = io.NopCloser(strings.NewReader(`{"id":"2"}`))
+			},
+			wantErr: "does not match the content",
+		},
+		{
+			name:   "tampered status",
+			client: NewHMACAuth("mytype", []byte{1, 2, 3}),
+			modify: func(rsp *http.Response) {
+				rsp.StatusCode = http.StatusAccepted
+			},
+			wantErr: "Wrong HMAC found",
+		},
+		{
+			name:   "tampered header",
+			client: NewHMACAuth("mytype", []byte{1, 2, 3}, WithSignedResponses("Content-Type")),
+			modify: func(rsp *http.Response) {
+				rsp.Header.Set("Content-Type", "text/html")
+			},
+			wantErr: "Wrong HMAC found",
+		},
+		{
+			name:    "header not signed",
+			client:  NewHMACAuth("mytype", []byte{1, 2, 3}, WithSignedResponses("Content-Type", "Location")),
+			wantErr: "the response header \"location\" must be signed",
+		},
+		{
+			name:    "wrong key",
+			client:  NewHMACAuth("mytype", []byte{4, 5, 6}),
+			wantErr: "Wrong HMAC found",
+		},
+		{
+			name:   "too old",
+			client: NewHMACAuth("mytype", []byte{1, 2, 3}),
+			modify: func(rsp *http.Response) {
+				rsp.Header.Set(TsHeaderKey, time.Now().Add(-time.Hour).UTC().Format(time.RFC3339))
+			},
+			wantErr: "not within the accepted clock skew",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rsp := signed(t)
+			if tt.modify != nil {
+				tt.modify(rsp)
+			}
+			err := tt.client.VerifyResponse(rsp)
+			if tt.wantErr != "" {
+				require.ErrorContains(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			body, err := io.ReadAll(rsp.Body)
+			require.NoError(t, err)
+			require.JSONEq(t, `{"id":"1"}`, string(body))
+		})
+	}
+}
+
+func TestHMACAuth_SignResponsesWithClientID(t *testing.T) {
+	master := []byte("master-secret")
+	server := NewHMACAuth("mytype", master, WithClientResolver(StaticClients(map[string]User{"c1": {Name: "c1"}})))
+	key, err := DeriveHMACKey(master, "mytype", "c1")
+	require.NoError(t, err)
+	client := NewHMACAuth("mytype", key, WithClientID("c1"))
+
+	rq := httptest.NewRequest(http.MethodGet, "/", nil)
+	client.AddAuth(rq, time.Now(), nil)
+	rec := httptest.NewRecorder()
+	server.SignResponses(http.HandlerFunc(func(w http.ResponseWriter, rq *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	})).ServeHTTP(rec, rq)
+	rsp := rec.Result()
+	rsp.Request = rq
+
+	require.NoError(t, client.VerifyResponse(rsp))
+}
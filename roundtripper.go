@@ -0,0 +1,165 @@
+package security
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// HMACRoundTripper is a http.RoundTripper which signs every request with a
+// HMACAuth when it is sent. Because the signature is created for every round
+// trip, retried requests get a fresh timestamp and salt.
+type HMACRoundTripper struct {
+	hma  HMACAuth
+	next http.RoundTripper
+	now  func() time.Time
+}
+
+// NewHMACRoundTripper returns a new HMACRoundTripper which signs the requests
+// with the given HMACAuth and sends them with next. If next is nil, the
+// http.DefaultTransport is used.
+func NewHMACRoundTripper(hma HMACAuth, next http.RoundTripper) *HMACRoundTripper {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return &HMACRoundTripper{
+		hma:  hma,
+		next: next,
+		now:  time.Now,
+	}
+}
+
+// RoundTrip implements the http.RoundTripper. The given request is not modified,
+// the signed request is a clone. Requests which are redirected to another host
+// are sent without credentials. If SignedResponses is enabled, responses which
+// are not signed by the server are rejected.
+func (h *HMACRoundTripper) RoundTrip(rq *http.Request) (*http.Response, error) {
+	if isCrossHostRedirect(rq) {
+		return h.next.RoundTrip(withoutCredentials(rq))
+	}
+
+	var body []byte
+	nrq := rq.Clone(rq.Context())
+	if h.hma.BodyDigest {
+		var err error
+		body, err = bufferBody(rq)
+		if err != nil {
+			return nil, err
+		}
+		nrq.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	headers, err := h.hma.authHeaders(clientRequestData(nrq, body), h.now())
+	if err != nil {
+		closeBody(rq)
+		return nil, err
+	}
+	for k, v := range headers {
+		nrq.Header.Set(k, v)
+	}
+	rsp, err := h.next.RoundTrip(nrq)
+	if err != nil || !h.hma.SignedResponses {
+		return rsp, err
+	}
+	if err := h.hma.VerifyResponse(rsp); err != nil {
+		_ = rsp.Body.Close()
+		return nil, fmt.Errorf("cannot verify response: %w", err)
+	}
+	return rsp, nil
+}
+
+// TokenFunc returns the bearer token which is added to a request.
+type TokenFunc func() (string, error)
+
+// StaticToken returns a TokenFunc which always returns the given token.
+func StaticToken(token string) TokenFunc {
+	return func() (string, error) {
+		return token, nil
+	}
+}
+
+// BearerRoundTripper is a http.RoundTripper which adds a bearer token to every
+// request when it is sent.
+type BearerRoundTripper struct {
+	token TokenFunc
+	next  http.RoundTripper
+}
+
+// NewBearerRoundTripper returns a new BearerRoundTripper which adds the token of
+// the given TokenFunc to the requests and sends them with next. If next is nil,
+// the http.DefaultTransport is used.
+func NewBearerRoundTripper(token TokenFunc, next http.RoundTripper) *BearerRoundTripper {
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return &BearerRoundTripper{
+		token: token,
+		next:  next,
+	}
+}
+
+// RoundTrip implements the http.RoundTripper. The given request is not modified,
+// the request with the token is a clone. Requests which are redirected to
+// another host are sent without credentials.
+func (b *BearerRoundTripper) RoundTrip(rq *http.Request) (*http.Response, error) {
+	if isCrossHostRedirect(rq) {
+		return b.next.RoundTrip(withoutCredentials(rq))
+	}
+
+	token, err := b.token()
+	if err != nil {
+		closeBody(rq)
+		return nil, fmt.Errorf("cannot get bearer token: %w", err)
+	}
+	nrq := rq.Clone(rq.Context())
+	nrq.Header.Set(AuthzHeaderKey, "Bearer "+token)
+	return b.next.RoundTrip(nrq)
+}
+
+// isCrossHostRedirect returns true if the request follows a redirect to another
+// host or from https to http.
+func isCrossHostRedirect(rq *http.Request) bool {
+	if rq.Response == nil {
+		return false
+	}
+	origin := rq
+	for origin.Response != nil && origin.Response.Request != nil {
+		origin = origin.Response.Request
+	}
+	if origin.URL.Scheme == "https" && rq.URL.Scheme != "https" {
+		return true
+	}
+	return origin.URL.Host != rq.URL.Host
+}
+
+// withoutCredentials returns a clone of the request without the headers which
+// authenticate it.
+func withoutCredentials(rq *http.Request) *http.Request {
+	nrq := rq.Clone(rq.Context())
+	for _, h := range []string{AuthzHeaderKey, TsHeaderKey, SaltHeaderKey} {
+		nrq.Header.Del(h)
+	}
+	return nrq
+}
+
+// bufferBody reads and closes the body of the request.
+func bufferBody(rq *http.Request) ([]byte, error) {
+	if rq.Body == nil || rq.Body == http.NoBody {
+		return nil, nil
+	}
+	defer closeBody(rq)
+	body, err := io.ReadAll(rq.Body)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read request body: %w", err)
+	}
+	return body, nil
+}
+
+// closeBody closes the body of the request, a http.RoundTripper must always
+// do this, even on errors.
+func closeBody(rq *http.Request) {
+	if rq.Body != nil {
+		_ = rq.Body.Close()
+	}
+}
@@ -0,0 +1,144 @@
+package security
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// useRandomSalt restores the random salts, the salts of TestMain cannot be sent
+// over the wire.
+func useRandomSalt(t *testing.T) {
+	old := randByteString
+	randByteString = randomByteString
+	t.Cleanup(func() { randByteString = old })
+}
+
+func TestHMACRoundTripper(t *testing.T) {
+	useRandomSalt(t)
+	u := User{Name: "Bicycle Repair Man"}
+	server := NewHMACAuth("mytype", []byte{1, 2, 3}, WithUser(u), WithBodyDigest(), WithCanonicalRequest())
+	client := NewHMACAuth("mytype", []byte{1, 2, 3}, WithBodyDigest(), WithCanonicalRequest())
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, rq *http.Request) {
+		usr, err := server.User(rq)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		if len(rq.Header.Values(AuthzHeaderKey)) != 1 {
+			http.Error(w, "multiple authorization headers", http.StatusBadRequest)
+			return
+		}
+		body, _ := io.ReadAll(rq.Body)
+		_, _ = w.Write([]byte(usr.Name + ":" + string(body)))
+	}))
+	defer srv.Close()
+
+	c := &http.Client{Transport: NewHMACRoundTripper(client, nil)}
+
+	rq, err := http.NewRequestWithContext(context.Background(), http.MethodPost, srv.URL+"/v1/machine?id=1", strings.NewReader("my-body"))
+	require.NoError(t, err)
+
+	// the request is signed again on every round trip
+	for range 2 {
+		if rq.GetBody != nil {
+			rq.Body, err = rq.GetBody()
+			require.NoError(t, err)
+		}
+		rsp, err := c.Do(rq)
+		require.NoError(t, err)
+		body, err := io.ReadAll(rsp.Body)
+		require.NoError(t, err)
+		_ = rsp.Body.Close()
+		require.Equal(t, http.StatusOK, rsp.StatusCode, string(body))
+		require.Equal(t, u.Name+":my-body", string(body))
+	}
+
+	// the request of the caller is not modified
+	require.Empty(t, rq.Header.Get(AuthzHeaderKey))
+
+	// a client with an unsupported algorithm does not send the request
+	c = &http.Client{Transport: NewHMACRoundTripper(NewHMACAuth("mytype", []byte{1, 2, 3}, WithAlgorithm("hmac-md5")), nil)}
+	_, err = c.Post(srv.URL, "text/plain", strings.NewReader("my-body"))
+	require.ErrorContains(t, err, "unsupported hmac algorithm \"hmac-md5\"")
+}
+
+func TestRoundTripper_Redirects(t *testing.T) {
+	useRandomSalt(t)
+	var target http.Header
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, rq *http.Request) {
+		target = rq.Header.Clone()
+	}))
+	defer other.Close()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, rq *http.Request) {
+		switch rq.URL.Path {
+		case "/cross":
+			http.Redirect(w, rq, other.URL+"/target", http.StatusFound)
+		case "/same":
+			http.Redirect(w, rq, "/target", http.StatusFound)
+		default:
+			target = rq.Header.Clone()
+		}
+	}))
+	defer srv.Close()
+
+	transports := map[string]http.RoundTripper{
+		"hmac":   NewHMACRoundTripper(NewHMACAuth("mytype", []byte{1, 2, 3}), nil),
+		"bearer": NewBearerRoundTripper(StaticToken("my-token"), nil),
+	}
+	for name, tr := range transports {
+		t.Run(name, func(t *testing.T) {
+			c := &http.Client{Transport: tr}
+
+			target = nil
+			rsp, err := c.Get(srv.URL + "/same")
+			require.NoError(t, err)
+			_ = rsp.Body.Close()
+			require.NotEmpty(t, target.Get(AuthzHeaderKey), "credentials must be sent on redirects to the same host")
+
+			target = nil
+			rsp, err = c.Get(srv.URL + "/cross")
+			require.NoError(t, err)
+			_ = rsp.Body.Close()
+			require.NotNil(t, target)
+			require.Empty(t, target.Get(AuthzHeaderKey), "credentials must not be sent to another host")
+			require.Empty(t, target.Get(SaltHeaderKey))
+		})
+	}
+}
+
+func TestBearerRoundTripper(t *testing.T) {
+	var auth string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, rq *http.Request) {
+		auth = rq.Header.Get(AuthzHeaderKey)
+	}))
+	defer srv.Close()
+
+	tokens := []string{"first", "second"}
+	c := &http.Client{Transport: NewBearerRoundTripper(func() (string, error) {
+		if len(tokens) == 0 {
+			return "", errors.New("no more tokens")
+		}
+		token := tokens[0]
+		tokens = tokens[1:]
+		return token, nil
+	}, nil)}
+
+	for _, want := range []string{"Bearer first", "Bearer second"} {
+		rsp, err := c.Get(srv.URL)
+		require.NoError(t, err)
+		_ = rsp.Body.Close()
+		require.Equal(t, want, auth)
+	}
+
+	_, err := c.Get(srv.URL)
+	require.ErrorContains(t, err, "cannot get bearer token: no more tokens")
+}
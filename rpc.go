@@ -0,0 +1,67 @@
+package security
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// ClientCredentials return the headers which authenticate a rpc of a client.
+// Remote procedure calls are always signed as POST requests to the path of the
+// procedure, e.g. "/grpc.health.v1.Health/Check".
+type ClientCredentials func(rqd RequestData) (map[string]string, error)
+
+// HMACCredentials returns ClientCredentials which sign the rpcs with the given
+// HMACAuth. The messages of a rpc cannot be signed, so BodyDigest must not be
+// enabled.
+func HMACCredentials(hma HMACAuth) ClientCredentials {
+	return func(rqd RequestData) (map[string]string, error) {
+		if hma.BodyDigest {
+			return nil, errors.New("the body of a rpc cannot be signed")
+		}
+		return hma.authHeaders(rqd, time.Now())
+	}
+}
+
+// BearerCredentials returns ClientCredentials which add the token of the given
+// TokenFunc as a bearer token to the rpcs.
+func BearerCredentials(token TokenFunc) ClientCredentials {
+	return func(RequestData) (map[string]string, error) {
+		t, err := token()
+		if err != nil {
+			return nil, err
+		}
+		return map[string]string{AuthzHeaderKey: "Bearer " + t}, nil
+	}
+}
+
+// rpcRequestData returns the RequestData of a rpc which is sent by a client.
+func rpcRequestData(procedure, host string, header http.Header) RequestData {
+	return RequestData{
+		Method: http.MethodPost,
+		Path:   procedure,
+		Host:   host,
+		Header: header,
+	}
+}
+
+// rpcUser passes a http request with the given headers to the UserGetter and
+// puts the returned user into the context.
+func rpcUser(ctx context.Context, ug UserGetter, procedure, host string, header http.Header) (context.Context, error) {
+	rq := (&http.Request{
+		Method:     http.MethodPost,
+		URL:        &url.URL{Path: procedure},
+		Proto:      "HTTP/2.0",
+		ProtoMajor: 2,
+		Host:       host,
+		Header:     header,
+		Body:       http.NoBody,
+	}).WithContext(ctx)
+	u, err := ug.User(rq)
+	if err != nil {
+		return nil, err
+	}
+	return PutUserInContext(ctx, u), nil
+}
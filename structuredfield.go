@@ -0,0 +1,362 @@
+package security
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// This file implements the subset of the structured field values of RFC 8941
+// which is needed for http message signatures, i.e. dictionaries whose members
+// are inner lists or items with parameters.
+
+// sfToken is a structured field token, it is serialized without quotes.
+type sfToken string
+
+// sfParam is a parameter of an item or inner list. The value is a string,
+// sfToken, int64, bool or []byte.
+type sfParam struct {
+	key   string
+	value any
+}
+
+type sfParams []sfParam
+
+func (ps sfParams) get(key string) (any, bool) {
+	for _, p := range ps {
+		if p.key == key {
+			return p.value, true
+		}
+	}
+	return nil, false
+}
+
+// sfMember is a member of a dictionary. Either list is set for an inner list
+// or item for a single item.
+type sfMember struct {
+	key    string
+	list   []string
+	item   any
+	isList bool
+	params sfParams
+}
+
+type sfParser struct {
+	s   string
+	pos int
+}
+
+// parseSFDictionary parses a dictionary. Items of inner lists must be strings
+// without parameters, which is sufficient for component identifiers.
+func parseSFDictionary(s string) ([]sfMember, error) {
+	p := &sfParser{s: s}
+	var res []sfMember
+	p.skipSpace()
+	for !p.done() {
+		key, err := p.parseKey()
+		if err != nil {
+			return nil, err
+		}
+		m := sfMember{key: key}
+		if p.peek() != '=' {
+			m.item = true
+		} else {
+			p.pos++
+			if p.peek() == '(' {
+				m.isList = true
+				m.list, err = p.parseInnerList()
+			} else {
+				m.item, err = p.parseBareItem()
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+		m.params, err = p.parseParams()
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, m)
+
+		p.skipOWS()
+		if p.done() {
+			break
+		}
+		if p.peek() != ',' {
+			return nil, p.errorf("expected ','")
+		}
+		p.pos++
+		p.skipOWS()
+		if p.done() {
+			return nil, p.errorf("trailing ','")
+		}
+	}
+	return res, nil
+}
+
+func (p *sfParser) done() bool {
+	return p.pos >= len(p.s)
+}
+
+func (p *sfParser) peek() byte {
+	if p.done() {
+		return 0
+	}
+	return p.s[p.pos]
+}
+
+func (p *sfParser) skipSpace() {
+	for p.peek() == ' ' {
+		p.pos++
+	}
+}
+
+func (p *sfParser) skipOWS() {
+	for p.peek() == ' ' || p.peek() == '\t' {
+		p.pos++
+	}
+}
+
+func (p *sfParser) errorf(format string, args ...any) error {
+	return fmt.Errorf("illegal structured field at position %d: %s", p.pos, fmt.Sprintf(format, args...))
+}
+
+func (p *sfParser) parseKey() (string, error) {
+	start := p.pos
+	c := p.peek()
+	if !(c >= 'a' && c <= 'z') && c != '*' {
+		return "", p.errorf("expected key")
+	}
+	for !p.done() {
+		c := p.peek()
+		if (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') || strings.IndexByte("_-.*", c) >= 0 {
+			p.pos++
+			continue
+		}
+		break
+	}
+	return p.s[start:p.pos], nil
+}
+
+func (p *sfParser) parseInnerList() ([]string, error) {
+	// skip the '('
+	p.pos++
+	var res []string
+	for {
+		p.skipSpace()
+		if p.peek() == ')' {
+			p.pos++
+			return res, nil
+		}
+		if p.peek() != '"' {
+			return nil, p.errorf("expected string in inner list")
+		}
+		item, err := p.parseString()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() == ';' {
+			return nil, p.errorf("parameters of component identifiers are not supported")
+		}
+		res = append(res, item)
+		if c := p.peek(); c != ' ' && c != ')' {
+			return nil, p.errorf("expected ' ' or ')' in inner list")
+		}
+	}
+}
+
+func (p *sfParser) parseParams() (sfParams, error) {
+	var res sfParams
+	for p.peek() == ';' {
+		p.pos++
+		p.skipSpace()
+		key, err := p.parseKey()
+		if err != nil {
+			return nil, err
+		}
+		var value any = true
+		if p.peek() == '=' {
+			p.pos++
+			value, err = p.parseBareItem()
+			if err != nil {
+				return nil, err
+			}
+		}
+		res = append(res, sfParam{key: key, value: value})
+	}
+	return res, nil
+}
+
+func (p *sfParser) parseBareItem() (any, error) {
+	c := p.peek()
+	switch {
+	case c == '"':
+		return p.parseString()
+	case c == ':':
+		return p.parseByteSequence()
+	case c == '?':
+		return p.parseBoolean()
+	case c == '-' || (c >= '0' && c <= '9'):
+		return p.parseInteger()
+	case (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || c == '*':
+		return p.parseToken()
+	default:
+		return nil, p.errorf("unexpected character %q", c)
+	}
+}
+
+func (p *sfParser) parseString() (string, error) {
+	// skip the opening quote
+	p.pos++
+	var sb strings.Builder
+	for !p.done() {
+		c := p.s[p.pos]
+		p.pos++
+		switch {
+		case c == '\\':
+			if p.done() || (p.peek() != '"' && p.peek() != '\\') {
+				return "", p.errorf("illegal escape in string")
+			}
+			sb.WriteByte(p.s[p.pos])
+			p.pos++
+		case c == '"':
+			return sb.String(), nil
+		case c < 0x20 || c > 0x7e:
+			return "", p.errorf("illegal character in string")
+		default:
+			sb.WriteByte(c)
+		}
+	}
+	return "", p.errorf("unterminated string")
+}
+
+func (p *sfParser) parseByteSequence() ([]byte, error) {
+	// skip the opening colon
+	p.pos++
+	end := strings.IndexByte(p.s[p.pos:], ':')
+	if end < 0 {
+		return nil, p.errorf("unterminated byte sequence")
+	}
+	b, err := base64.StdEncoding.DecodeString(p.s[p.pos : p.pos+end])
+	if err != nil {
+		return nil, p.errorf("illegal byte sequence: %v", err)
+	}
+	p.pos += end + 1
+	return b, nil
+}
+
+func (p *sfParser) parseBoolean() (bool, error) {
+	if p.pos+1 >= len(p.s) {
+		return false, p.errorf("illegal boolean")
+	}
+	v := p.s[p.pos+1]
+	p.pos += 2
+	switch v {
+	case '1':
+		return true, nil
+	case '0':
+		return false, nil
+	default:
+		return false, p.errorf("illegal boolean")
+	}
+}
+
+func (p *sfParser) parseInteger() (int64, error) {
+	start := p.pos
+	if p.peek() == '-' {
+		p.pos++
+	}
+	for c := p.peek(); c >= '0' && c <= '9'; c = p.peek() {
+		p.pos++
+	}
+	if p.peek() == '.' {
+		return 0, p.errorf("decimals are not supported")
+	}
+	digits := p.s[start:p.pos]
+	if len(strings.TrimPrefix(digits, "-")) == 0 || len(strings.TrimPrefix(digits, "-")) > 15 {
+		return 0, p.errorf("illegal integer %q", digits)
+	}
+	return strconv.ParseInt(digits, 10, 64)
+}
+
+func (p *sfParser) parseToken() (sfToken, error) {
+	start := p.pos
+	for !p.done() {
+		c := p.peek()
+		// tchar, ':' and '/'
+		if c > 0x20 && c < 0x7f && strings.IndexByte("\"(),;<=>?@[\\]{}", c) < 0 {
+			p.pos++
+			continue
+		}
+		break
+	}
+	return sfToken(p.s[start:p.pos]), nil
+}
+
+// serializeSFInnerList serializes an inner list of strings with parameters.
+func serializeSFInnerList(items []string, params sfParams) (string, error) {
+	var sb strings.Builder
+	sb.WriteByte('(')
+	for i, item := range items {
+		if i > 0 {
+			sb.WriteByte(' ')
+		}
+		s, err := serializeSFString(item)
+		if err != nil {
+			return "", err
+		}
+		sb.WriteString(s)
+	}
+	sb.WriteByte(')')
+	for _, p := range params {
+		sb.WriteString(";" + p.key)
+		if b, ok := p.value.(bool); ok && b {
+			continue
+		}
+		v, err := serializeSFBareItem(p.value)
+		if err != nil {
+			return "", err
+		}
+		sb.WriteString("=" + v)
+	}
+	return sb.String(), nil
+}
+
+func serializeSFBareItem(v any) (string, error) {
+	switch v := v.(type) {
+	case string:
+		return serializeSFString(v)
+	case sfToken:
+		return string(v), nil
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	case bool:
+		if v {
+			return "?1", nil
+		}
+		return "?0", nil
+	case []byte:
+		return ":" + base64.StdEncoding.EncodeToString(v) + ":", nil
+	default:
+		return "", fmt.Errorf("unsupported structured field item %T", v)
+	}
+}
+
+func serializeSFString(s string) (string, error) {
+	var sb strings.Builder
+	sb.WriteByte('"')
+	for i := range len(s) {
+		c := s[i]
+		if c < 0x20 || c > 0x7e {
+			return "", errors.New("illegal character in structured field string")
+		}
+		if c == '"' || c == '\\' {
+			sb.WriteByte('\\')
+		}
+		sb.WriteByte(c)
+	}
+	sb.WriteByte('"')
+	return sb.String(), nil
+}
@@ -0,0 +1,89 @@
+package security
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_parseSFDictionary(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    []sfMember
+		wantErr string
+	}{
+		{
+			name:  "signature input",
+			input: `sig1=("@method" "@path" "content-digest");created=1618884473;keyid="test-key";alg="ed25519", sig2=();created=1`,
+			want: []sfMember{
+				{
+					key:    "sig1",
+					isList: true,
+					list:   []string{"@method", "@path", "content-digest"},
+					params: sfParams{{key: "created", value: int64(1618884473)}, {key: "keyid", value: "test-key"}, {key: "alg", value: "ed25519"}},
+				},
+				{
+					key:    "sig2",
+					isList: true,
+					params: sfParams{{key: "created", value: int64(1)}},
+				},
+			},
+		},
+		{
+			name:  "signature",
+			input: `sig1=:AQID:, b=?0, c;d=tok/en:x, e="a\"b"`,
+			want: []sfMember{
+				{key: "sig1", item: []byte{1, 2, 3}},
+				{key: "b", item: false},
+				{key: "c", item: true, params: sfParams{{key: "d", value: sfToken("tok/en:x")}}},
+				{key: "e", item: `a"b`},
+			},
+		},
+		{
+			name:    "trailing comma",
+			input:   `sig1=:AQID:,`,
+			wantErr: "illegal structured field at position 12: trailing ','",
+		},
+		{
+			name:    "uppercase key",
+			input:   `Sig1=:AQID:`,
+			wantErr: "illegal structured field at position 0: expected key",
+		},
+		{
+			name:    "component with parameters",
+			input:   `sig1=("@query-param";name="id")`,
+			wantErr: "illegal structured field at position 20: parameters of component identifiers are not supported",
+		},
+		{
+			name:    "unterminated string",
+			input:   `sig1=("@method)`,
+			wantErr: "illegal structured field at position 15: unterminated string",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseSFDictionary(tt.input)
+			if tt.wantErr != "" {
+				require.EqualError(t, err, tt.wantErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func Test_serializeSFInnerList(t *testing.T) {
+	got, err := serializeSFInnerList([]string{"@method", "content-digest"}, sfParams{
+		{key: "created", value: int64(1618884473)},
+		{key: "keyid", value: `test"key`},
+		{key: "flag", value: true},
+		{key: "tag", value: sfToken("abc")},
+	})
+	require.NoError(t, err)
+	require.Equal(t, `("@method" "content-digest");created=1618884473;keyid="test\"key";flag;tag=abc`, got)
+
+	_, err = serializeSFInnerList([]string{"ä"}, nil)
+	require.EqualError(t, err, "illegal character in structured field string")
+}
@@ -37,6 +37,8 @@ type TokenCfg struct {
 	PreferredName string
 	Email         string
 	Roles         []string
+	// ExtraClaims are added to the claims of the token.
+	ExtraClaims map[string]any
 }
 
 const (
@@ -104,7 +106,11 @@ func CreateTokenAndKeys(cfg *TokenCfg) (token string, pubKey jose.JSONWebKey, pr
 
 	signer := MustMakeSigner(cfg.Alg, privKey)
 
-	token, err = CreateToken(signer, cl, pcl)
+	extra := []any{pcl}
+	if len(cfg.ExtraClaims) > 0 {
+		extra = append(extra, cfg.ExtraClaims)
+	}
+	token, err = CreateToken(signer, cl, extra...)
 	if err != nil {
 		return "", jose.JSONWebKey{}, jose.JSONWebKey{}, err
 	}
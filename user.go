@@ -17,17 +17,27 @@ type User struct {
 	Project string
 	Issuer  string
 	Subject string
+
+	anonymous bool
 }
 
 var (
 	guest = User{
-		EMail:  "anonymous@metal-stack.io",
-		Name:   "anonymous",
-		Groups: []ResourceAccess{},
+		EMail:     "anonymous@metal-stack.io",
+		Name:      "anonymous",
+		Groups:    []ResourceAccess{},
+		anonymous: true,
 	}
-	errNoAuthFound = errors.New("no auth found")
+	errNoAuthFound       = &AuthError{Kind: AuthErrorNoCredentials, Err: errors.New("no auth found")}
+	errAnonymousRejected = errors.New("no auth found, anonymous requests are not allowed")
 )
 
+// IsAnonymous returns true if the user is not authenticated, i.e. it is the
+// guest or the anonymous user of a UserCreds.
+func (u *User) IsAnonymous() bool {
+	return u == nil || u.anonymous
+}
+
 // ResourceAccess is the type for our groups
 type ResourceAccess string
 
@@ -53,6 +63,48 @@ func (u *User) HasGroup(grps ...ResourceAccess) bool {
 	return false
 }
 
+// HasAllGroups returns true if the user has all of the given groups. It
+// returns false if no groups are given, so an empty list of required groups
+// does not let everyone through.
+func (u *User) HasAllGroups(grps ...ResourceAccess) bool {
+	if len(grps) == 0 {
+		return false
+	}
+	acc := accessGroup(u.Groups).asSet()
+	for _, grp := range grps {
+		if ok := acc[grp]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// MayAccessTenant returns true if the user belongs to the given tenant. A user
+// which has one of the given provider admin groups may access every tenant.
+// Anonymous users may not access any tenant.
+func (u *User) MayAccessTenant(tenant string, providerAdmins ...ResourceAccess) bool {
+	if u.IsAnonymous() {
+		return false
+	}
+	if u.HasGroup(providerAdmins...) {
+		return true
+	}
+	return tenant != "" && u.Tenant == tenant
+}
+
+// MayAccessProject returns true if the user may access the given project of
+// the tenant. A user without a project may access all projects of its tenant,
+// otherwise the project must match. Provider admins may access every project.
+func (u *User) MayAccessProject(tenant, project string, providerAdmins ...ResourceAccess) bool {
+	if !u.MayAccessTenant(tenant, providerAdmins...) {
+		return false
+	}
+	if u.HasGroup(providerAdmins...) {
+		return true
+	}
+	return u.Project == "" || u.Project == project
+}
+
 // A UserGetter returns the authenticated user from the request.
 type UserGetter interface {
 	User(rq *http.Request) (*User, error)
@@ -60,8 +112,11 @@ type UserGetter interface {
 
 // UserCreds stores different methods for user extraction from a request.
 type UserCreds struct {
-	dex       UserGetter
-	macauther []HMACAuth
+	dex             UserGetter
+	macauther       []HMACAuth
+	anonymous       User
+	rejectAnonymous bool
+	trace           bool
 }
 
 // CredsOpt is a option setter for UserCreds
@@ -70,7 +125,7 @@ type CredsOpt func(*UserCreds)
 // NewCreds returns a credential checker which tries to pull out the current user
 // of a request. You can set many different HMAC auth'ers but only one for bearer tokens.
 func NewCreds(opts ...CredsOpt) *UserCreds {
-	res := &UserCreds{}
+	res := &UserCreds{anonymous: guest}
 
 	for _, o := range opts {
 		o(res)
@@ -93,28 +148,76 @@ func WithHMAC(hma HMACAuth) CredsOpt {
 	}
 }
 
+// WithAnonymous sets the user which is returned if no auther returns a user. The
+// returned user is anonymous, no matter how the given user is configured.
+func WithAnonymous(u User) CredsOpt {
+	return func(uc *UserCreds) {
+		u.anonymous = true
+		uc.anonymous = u
+	}
+}
+
+// RejectAnonymous lets UserCreds return an error of the kind
+// AuthErrorNoCredentials if no auther returns a user.
+func RejectAnonymous() CredsOpt {
+	return func(uc *UserCreds) {
+		uc.rejectAnonymous = true
+	}
+}
+
+// WithAuthTrace records the outcome of every auther in the AuthTrace of the
+// context of the request, see ContextWithAuthTrace. If anonymous requests are
+// rejected, the returned error also contains the errors of all authers.
+func WithAuthTrace() CredsOpt {
+	return func(uc *UserCreds) {
+		uc.trace = true
+	}
+}
+
 // User pulls out a user from the request. It uses all authers
 // which where specified when creating this usercred. the first
 // auther which returns a user wins.
-// if no auther returns a user, a guest with no rights will be returned.
+// if no auther returns a user, a guest with no rights will be returned, unless
+// anonymous requests are rejected.
 func (uc *UserCreds) User(rq *http.Request) (*User, error) {
 	authers := make([]UserGetter, 0, len(uc.macauther)+1)
+	names := make([]string, 0, len(uc.macauther)+1)
 	for i := range uc.macauther {
 		authers = append(authers, &uc.macauther[i])
+		names = append(names, "hmac:"+uc.macauther[i].Type)
 	}
 	if uc.dex != nil {
 		authers = append(authers, uc.dex)
+		names = append(names, "dex")
 	}
-	for _, auth := range authers {
+	var trace *AuthTrace
+	if uc.trace {
+		trace = AuthTraceFromContext(rq.Context())
+		if trace == nil {
+			// collect the attempts for the error anyway
+			trace = &AuthTrace{}
+		}
+	}
+	for i, auth := range authers {
 		u, err := auth.User(rq)
+		trace.add(AuthAttempt{Authenticator: names[i], Err: err})
 		if err == nil {
 			return u, nil
 		}
-		if !errors.Is(err, errNoAuthFound) && !errors.Is(err, errIllegalAuthFound) && !errors.Is(err, errUnknownAuthFound) {
+		if !isSkippable(err) {
 			return nil, err
 		}
 	}
-	return &guest, nil
+	if uc.rejectAnonymous {
+		err := errAnonymousRejected
+		if trace != nil {
+			err = errors.Join(err, trace.Err())
+		}
+		return nil, &AuthError{Kind: AuthErrorNoCredentials, Authenticator: "usercreds", Err: err}
+	}
+	// lets return a copy of our user so the caller cannot change it
+	anonymous := uc.anonymous
+	return &anonymous, nil
 }
 
 // AddUserToken adds the given token as a bearer token to the request.
@@ -1,6 +1,14 @@
 package security
 
-import "testing"
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
 
 func TestUser_HasGroup(t *testing.T) {
 	type fields struct {
@@ -76,3 +84,96 @@ func TestUser_HasGroup(t *testing.T) {
 		})
 	}
 }
+
+func TestUserCreds_Anonymous(t *testing.T) {
+	hma := NewHMACAuth("mytype", []byte{1, 2, 3})
+	signed := httptest.NewRequest(http.MethodGet, "/", nil)
+	hma.AddAuth(signed, time.Now(), nil)
+	unsigned := httptest.NewRequest(http.MethodGet, "/", nil)
+
+	t.Run("guest", func(t *testing.T) {
+		uc := NewCreds(WithHMAC(hma))
+		u, err := uc.User(unsigned)
+		require.NoError(t, err)
+		require.True(t, u.IsAnonymous())
+		require.Equal(t, "anonymous", u.Name)
+
+		// the guest cannot be changed by the caller
+		u.Name = "changed"
+		u, err = uc.User(unsigned)
+		require.NoError(t, err)
+		require.Equal(t, "anonymous", u.Name)
+
+		// the default user of a HMACAuth is authenticated
+		u, err = uc.User(signed)
+		require.NoError(t, err)
+		require.False(t, u.IsAnonymous())
+	})
+
+	t.Run("own anonymous user", func(t *testing.T) {
+		uc := NewCreds(WithHMAC(hma), WithAnonymous(User{Name: "visitor", Groups: []ResourceAccess{"public"}}))
+		u, err := uc.User(unsigned)
+		require.NoError(t, err)
+		require.True(t, u.IsAnonymous())
+		require.Equal(t, "visitor", u.Name)
+		require.True(t, u.HasGroup("public"))
+	})
+
+	t.Run("reject anonymous", func(t *testing.T) {
+		uc := NewCreds(WithHMAC(hma), RejectAnonymous())
+		_, err := uc.User(unsigned)
+		require.ErrorIs(t, err, &AuthError{Kind: AuthErrorNoCredentials})
+		require.EqualError(t, err, "no auth found, anonymous requests are not allowed")
+
+		u, err := uc.User(signed)
+		require.NoError(t, err)
+		require.False(t, u.IsAnonymous())
+	})
+}
+
+func TestUser_IsAnonymous(t *testing.T) {
+	var u *User
+	require.True(t, u.IsAnonymous())
+	require.True(t, GetUserFromContext(context.Background()).IsAnonymous())
+	require.False(t, (&User{Name: "anonymous"}).IsAnonymous())
+}
+
+func TestUser_MayAccessProject(t *testing.T) {
+	admins := []ResourceAccess{"Provider_metal-all-all-admin"}
+	tenantUser := &User{Name: "tu", Tenant: "t1"}
+	projectUser := &User{Name: "pu", Tenant: "t1", Project: "p1"}
+	providerAdmin := &User{Name: "pa", Tenant: "provider", Groups: admins}
+
+	tests := []struct {
+		name          string
+		user          *User
+		tenant        string
+		project       string
+		wantTenant    bool
+		wantProjectOK bool
+	}{
+		{name: "tenant user in own tenant", user: tenantUser, tenant: "t1", project: "p2", wantTenant: true, wantProjectOK: true},
+		{name: "tenant user in other tenant", user: tenantUser, tenant: "t2", project: "p2"},
+		{name: "project user in own project", user: projectUser, tenant: "t1", project: "p1", wantTenant: true, wantProjectOK: true},
+		{name: "project user in other project", user: projectUser, tenant: "t1", project: "p2", wantTenant: true},
+		{name: "provider admin", user: providerAdmin, tenant: "t2", project: "p2", wantTenant: true, wantProjectOK: true},
+		{name: "empty tenant", user: &User{Name: "x"}, tenant: "", project: ""},
+		{name: "anonymous", user: &guest, tenant: "t1", project: "p1"},
+		{name: "no user", tenant: "t1", project: "p1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.Equal(t, tt.wantTenant, tt.user.MayAccessTenant(tt.tenant, admins...))
+			require.Equal(t, tt.wantProjectOK, tt.user.MayAccessProject(tt.tenant, tt.project, admins...))
+		})
+	}
+}
+
+func TestUser_HasAllGroups(t *testing.T) {
+	u := &User{Groups: []ResourceAccess{"a", "b", "c"}}
+	require.False(t, u.HasAllGroups())
+	require.True(t, u.HasAllGroups("a"))
+	require.True(t, u.HasAllGroups("a", "c"))
+	require.False(t, u.HasAllGroups("a", "d"))
+	require.False(t, u.HasAllGroups("d"))
+}
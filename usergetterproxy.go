@@ -34,10 +34,12 @@ func UserGetterProxyMapping(issuer, clientid string, userGetter UserGetter) User
 	}
 }
 
+// User implements the UserGetter to get a user from the request. All errors
+// are of the type *AuthError.
 func (u *UserGetterProxy) User(rq *http.Request) (*User, error) {
 	claims, err := ParseTokenClaimsUnvalidated(rq)
 	if err != nil {
-		return nil, err
+		return nil, newAuthError("usergetterproxy", AuthErrorMalformed, err)
 	}
 
 	issuer := claims.Issuer
@@ -58,5 +60,9 @@ func (u *UserGetterProxy) User(rq *http.Request) (*User, error) {
 		return nil, nil
 	}
 
-	return ug.User(rq)
+	user, err := ug.User(rq)
+	if err != nil {
+		return nil, newAuthError("usergetterproxy", AuthErrorInvalidCredentials, err)
+	}
+	return user, nil
 }